@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// role is a user's permission level. Each role can do everything the roles below it can.
+type role int
+
+const (
+	roleNone     role = iota // Updates are ignored.
+	roleViewer               // Can read posts, statistics and settings.
+	roleLabeller             // Can also label and hide posts, and request posts to label.
+	roleAdmin                // Can also change feeds, rules and thresholds, and delete posts.
+)
+
+// Names of the roles in the config.
+var roleNames = map[string]role{
+	"none":     roleNone,
+	"viewer":   roleViewer,
+	"labeller": roleLabeller,
+	"admin":    roleAdmin,
+}
+
+func (r role) String() string {
+	for name, value := range roleNames {
+		if value == r {
+			return name
+		}
+	}
+	return fmt.Sprintf("role(%d)", int(r))
+}
+
+// Roles needed for each command. Commands that aren't listed need admin.
+var commandRoles = map[string]role{
+	"start":       roleViewer,
+	"help":        roleViewer,
+	"cancel":      roleViewer,
+	"follows":     roleViewer,
+	"status":      roleViewer,
+	"stats":       roleViewer,
+	"deadletters": roleViewer,
+	"label":       roleLabeller,
+	"add":         roleLabeller,
+}
+
+// Roles needed for each inline keyboard button. Buttons that aren't listed need admin.
+var callbackRoles = map[string]role{
+	"cb_print":      roleViewer,
+	"cb_hide":       roleLabeller, // Hiding deletes the notification for everyone in the chat.
+	"cb_true":       roleLabeller,
+	"cb_false":      roleLabeller,
+	"cb_remind_off": roleLabeller,
+}
+
+// commandRole returns the role needed to run a command with the given arguments.
+func commandRole(command string, arguments []string) role {
+	// Listing rules and thresholds is read-only, but changing them isn't.
+	switch {
+	case command == "rule" && len(arguments) > 0 && arguments[0] == "list":
+		return roleViewer
+	case command == "threshold" && len(arguments) == 0:
+		return roleViewer
+	}
+	if r, ok := commandRoles[command]; ok {
+		return r
+	}
+	return roleAdmin
+}
+
+// callbackRole returns the role needed to press an inline keyboard button.
+func callbackRole(button string) role {
+	if r, ok := callbackRoles[button]; ok {
+		return r
+	}
+	return roleAdmin
+}
+
+// userRole returns the role of a user in a chat.
+// Users listed in the config have their listed role in any allowed chat, and in a private chat with the bot.
+// Other users in an allowed chat have the default role.
+func userRole(chat *tgbotapi.Chat, user *tgbotapi.User) role {
+	if chat == nil {
+		return roleNone
+	}
+
+	chatAllowed := false
+	for _, id := range conf.Telegram.AllowedChats {
+		if chat.ID == id {
+			chatAllowed = true
+			break
+		}
+	}
+
+	if user != nil {
+		if name, ok := conf.Telegram.Users[user.ID]; ok && (chatAllowed || chat.IsPrivate()) {
+			return roleNames[name]
+		}
+	}
+	if chatAllowed {
+		return roleNames[conf.Telegram.DefaultRole]
+	}
+	return roleNone
+}
+
+// updateRole returns the role of the sender of a message or callback.
+func updateRole(update tgbotapi.Update) role {
+	switch {
+	case update.CallbackQuery != nil:
+		if update.CallbackQuery.Message == nil {
+			return roleNone
+		}
+		return userRole(update.CallbackQuery.Message.Chat, update.CallbackQuery.From)
+	case update.Message != nil:
+		return userRole(update.Message.Chat, update.Message.From)
+	default:
+		return roleNone
+	}
+}
+
+// logUnauthorised records an update that was ignored because its sender isn't allowed.
+func logUnauthorised(update tgbotapi.Update) {
+	var chat *tgbotapi.Chat
+	var user *tgbotapi.User
+	switch {
+	case update.CallbackQuery != nil:
+		user = update.CallbackQuery.From
+		if update.CallbackQuery.Message != nil {
+			chat = update.CallbackQuery.Message.Chat
+		}
+	case update.Message != nil:
+		chat = update.Message.Chat
+		user = update.Message.From
+	default:
+		return
+	}
+
+	chatText, userText := "unknown chat", "unknown user"
+	if chat != nil {
+		chatText = fmt.Sprintf("chat %d", chat.ID)
+	}
+	if user != nil {
+		userText = fmt.Sprintf("user %d (@%s)", user.ID, user.UserName)
+	}
+	log.Printf("Ignoring update from %s in %s.\n", userText, chatText)
+}
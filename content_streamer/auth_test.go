@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestCallbackRole(t *testing.T) {
+	tests := []struct {
+		button string
+		want   role
+	}{
+		{"cb_print", roleViewer},
+		{"cb_hide", roleLabeller},
+		{"cb_true", roleLabeller},
+		{"cb_false", roleLabeller},
+		{"cb_remind_off", roleLabeller},
+		{"cb_delete", roleAdmin},
+		{"cb_unfollow", roleAdmin},
+		{"cb_unknown", roleAdmin},
+	}
+	for _, test := range tests {
+		if got := callbackRole(test.button); got != test.want {
+			t.Errorf("callbackRole(%q) = %s, want %s", test.button, got, test.want)
+		}
+	}
+}
+
+func TestCommandRole(t *testing.T) {
+	tests := []struct {
+		command   string
+		arguments []string
+		want      role
+	}{
+		{"status", nil, roleViewer},
+		{"rule", []string{"list"}, roleViewer},
+		{"rule", []string{"add", "never", "tag", "nsfw"}, roleAdmin},
+		{"threshold", nil, roleViewer},
+		{"threshold", []string{"0.5"}, roleAdmin},
+		{"label", nil, roleLabeller},
+		{"follow", nil, roleAdmin},
+	}
+	for _, test := range tests {
+		if got := commandRole(test.command, test.arguments); got != test.want {
+			t.Errorf("commandRole(%q, %q) = %s, want %s", test.command, test.arguments, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Adaptive polling learns how often each DeviantArt feed posts, and how often its posts are worth notifying, to decide how often to poll it.
+const (
+	cadenceHistory = 20                  // Number of post times and positive labels kept per feed.
+	pollsPerPost   = 4                   // Polls per expected post, so a new post waits a fraction of the feed's usual gap.
+	positiveWindow = 30 * 24 * time.Hour // Positive labels older than this no longer speed a feed up.
+)
+
+// trimHistory returns times sorted, keeping the newest cadenceHistory of them.
+func trimHistory(times []int64) []int64 {
+	// Copy, as the slice may be shared with the scheduler's copy of the feed.
+	times = append([]int64(nil), times...)
+	sort.Slice(times, func(i, j int) bool {
+		return times[i] < times[j]
+	})
+	if len(times) > cadenceHistory {
+		times = times[len(times)-cadenceHistory:]
+	}
+	return times
+}
+
+// dAPollInterval returns the time between polls of a feed.
+// Hot feeds are polled at the minimum delay. Otherwise the delay is the feed's average time between posts, divided by pollsPerPost,
+// counting the time since its latest post so a feed that's gone quiet slows down. Each recent positive label shortens it further.
+func dAPollInterval(feed dAFeed) time.Duration {
+	if feed.Hot {
+		return conf.Polling.MinDelay
+	}
+	if !conf.Polling.Adaptive || len(feed.RecentPostTimes) < 2 {
+		return conf.Polling.Delay
+	}
+
+	now := time.Now()
+	span := now.Sub(time.Unix(feed.RecentPostTimes[0], 0))
+	interval := span / time.Duration(len(feed.RecentPostTimes)) / pollsPerPost
+
+	positives := 0
+	for _, at := range feed.Positives {
+		if now.Sub(time.Unix(at, 0)) < positiveWindow {
+			positives++
+		}
+	}
+	interval /= time.Duration(1 + positives)
+
+	if interval < conf.Polling.MinDelay {
+		return conf.Polling.MinDelay
+	}
+	if interval > conf.Polling.MaxDelay {
+		return conf.Polling.MaxDelay
+	}
+	return interval
+}
+
+// recordPositiveLabel notes that a post was labelled as worth notifying against the DeviantArt feed it came from, so the feed is polled more often.
+// Posts from other sites, or downloaded before feeds were recorded on posts, are ignored.
+func recordPositiveLabel(site string, id string) {
+	post, err := db.getPost(site, id)
+	if err != nil {
+		log.Printf("Failed to read post %s to record its label.\nError: %s\n", id, err)
+		return
+	}
+	d, ok := post.(deviation)
+	if !ok || d.Feed == "" {
+		return
+	}
+	feed, err := parseDAFeedKey(d.Feed)
+	if err != nil {
+		return
+	}
+
+	at := time.Now().Unix()
+	err = db.addDAFeedPositive(feed, at)
+	if err != nil {
+		log.Printf("Failed to record positive label on feed %s.\nError: %s\n", d.Feed, err)
+		return
+	}
+	dASchedule.update(d.Feed, func(f *dAFeed) {
+		f.Positives = trimHistory(append(f.Positives, at))
+	})
+}
+
+// hotCommand handles the arguments of the /hot command, returning the reply.
+// The form is "site feed [on|off]". Hot feeds are always polled at the minimum delay.
+func hotCommand(arguments []string) string {
+	if len(arguments) != 2 && len(arguments) != 3 {
+		return "Sorry, I don't know how to parse those parameters. Check /help for usage."
+	}
+	site, err := parseSiteName(arguments[0])
+	if err != nil {
+		return "Sorry, I don't recognise that site. Check /help for the implemented sites."
+	}
+	if _, ok := site.(deviation); !ok {
+		return fmt.Sprintf("Sorry, %s feeds aren't polled adaptively.", site.prettySiteName())
+	}
+
+	hot := true
+	if len(arguments) == 3 {
+		switch arguments[2] {
+		case "on":
+		case "off":
+			hot = false
+		default:
+			return "Sorry, that should be on or off."
+		}
+	}
+
+	name := arguments[1]
+	_, err = findFeed(site, name)
+	if err != nil {
+		return fmt.Sprintf("Sorry, I'm not following %s on %s.", name, site.prettySiteName())
+	}
+	feed, err := parseDAFeedKey(name)
+	if err == nil {
+		err = db.setDAFeedHot(feed, hot)
+	}
+	if err != nil {
+		return fmt.Sprintf("Sorry, I couldn't change %s.\nError: %s", name, err)
+	}
+	dASchedule.update(name, func(f *dAFeed) {
+		f.Hot = hot
+	})
+
+	if hot {
+		return fmt.Sprintf("%s is now polled every %s.", name, conf.Polling.MinDelay)
+	}
+	return fmt.Sprintf("%s is now polled adaptively.", name)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// ago returns the unix times of the given durations before now.
+func ago(durations ...time.Duration) []int64 {
+	times := make([]int64, 0, len(durations))
+	for _, d := range durations {
+		times = append(times, time.Now().Add(-d).Unix())
+	}
+	return times
+}
+
+func TestDAPollInterval(t *testing.T) {
+	fourHours := ago(4*time.Hour, 3*time.Hour, 2*time.Hour, time.Hour)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name     string
+		adaptive bool
+		feed     dAFeed
+		want     time.Duration
+	}{
+		{"not adaptive", false, dAFeed{RecentPostTimes: fourHours}, 5 * time.Minute},
+		{"hot", true, dAFeed{Hot: true, RecentPostTimes: fourHours}, time.Minute},
+		{"hot when not adaptive", false, dAFeed{Hot: true}, time.Minute},
+		{"no posts", true, dAFeed{}, 5 * time.Minute},
+		{"one post", true, dAFeed{RecentPostTimes: ago(time.Hour)}, 5 * time.Minute},
+		// Four posts in four hours is one an hour, polled four times an hour.
+		{"average", true, dAFeed{RecentPostTimes: fourHours}, 15 * time.Minute},
+		{"quiet since latest post", true, dAFeed{RecentPostTimes: ago(8*time.Hour, 7*time.Hour, 6*time.Hour, 5*time.Hour)}, 30 * time.Minute},
+		{"one positive", true, dAFeed{RecentPostTimes: fourHours, Positives: ago(day)}, 7*time.Minute + 30*time.Second},
+		{"two positives", true, dAFeed{RecentPostTimes: fourHours, Positives: ago(day, 2*day)}, 5 * time.Minute},
+		{"expired positive", true, dAFeed{RecentPostTimes: fourHours, Positives: ago(31 * day)}, 15 * time.Minute},
+		{"clamped to min", true, dAFeed{RecentPostTimes: ago(5*time.Minute, 3*time.Minute, time.Minute)}, time.Minute},
+		{"positives clamped to min", true, dAFeed{RecentPostTimes: fourHours, Positives: ago(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16)}, time.Minute},
+		{"clamped to max", true, dAFeed{RecentPostTimes: ago(30*day, 29*day)}, time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf = defaultConfig()
+			conf.Polling.Adaptive = test.adaptive
+			conf.Polling.Delay = 5 * time.Minute
+			conf.Polling.MinDelay = time.Minute
+			conf.Polling.MaxDelay = time.Hour
+
+			got := dAPollInterval(test.feed).Round(time.Second)
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	var times []int64
+	for i := int64(30); i > 0; i-- {
+		times = append(times, i)
+	}
+	trimmed := trimHistory(times)
+	if len(trimmed) != cadenceHistory || trimmed[0] != 11 || trimmed[len(trimmed)-1] != 30 {
+		t.Errorf("got %v, want the newest %d times in order", trimmed, cadenceHistory)
+	}
+	if times[0] != 30 {
+		t.Error("trimming changed the original slice")
+	}
+
+	short := trimHistory([]int64{3, 1, 2})
+	if fmt.Sprint(short) != "[1 2 3]" {
+		t.Errorf("got %v, want every time sorted", short)
+	}
+}
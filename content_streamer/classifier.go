@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errClassifierUnavailable wraps any failure to get a response from the classifier.
+var errClassifierUnavailable = errors.New("classifier unavailable")
+
+// errBadResponse wraps a response from the classifier that couldn't be decoded.
+var errBadResponse = errors.New("failed to decode response")
+
+// errCircuitOpen is returned without contacting the classifier while the circuit breaker is open.
+var errCircuitOpen = fmt.Errorf("%w: circuit breaker open", errClassifierUnavailable)
+
+// Policies for posts that can't be classified because the classifier is unavailable.
+const (
+	fallbackQueue  = "queue"  // Hold the post and classify it once the classifier recovers.
+	fallbackNotify = "notify" // Notify the post without a score.
+	fallbackDrop   = "drop"   // Don't notify the post.
+)
+
+// Struct to store results from the classifier.
+type classificationResult struct {
+	Success          bool
+	Error            string
+	ErrorDescription string `json:"error_description"`
+	ID               string
+	Site             string
+	Notify           bool
+	Score            float64
+}
+
+// classifierResponseError is returned when the classifier responds, but reports that the request failed.
+type classifierResponseError struct {
+	Type        string
+	Description string
+}
+
+func (e classifierResponseError) Error() string {
+	if e.Type == "" {
+		return "request failed"
+	}
+	if e.Description == "" {
+		return e.Type
+	}
+	return fmt.Sprintf("%s: %s", e.Type, e.Description)
+}
+
+// classifierClient calls the ml_webhooks API.
+type classifierClient struct {
+	baseURL        string
+	timeout        time.Duration // Timeout of each request, other than retraining.
+	retrainTimeout time.Duration
+	retries        int           // Number of retries after a failed request.
+	retryBackoff   time.Duration // Delay before the first retry. Doubles on each retry.
+	breaker        *circuitBreaker
+	http           *http.Client
+}
+
+// Global classifier client.
+var classifier *classifierClient
+
+func newClassifierClient(c config) *classifierClient {
+	return &classifierClient{
+		baseURL:        c.Classifier.URL,
+		timeout:        c.Classifier.Timeout,
+		retrainTimeout: c.Classifier.RetrainTimeout,
+		retries:        c.Classifier.Retries,
+		retryBackoff:   c.Classifier.RetryBackoff,
+		breaker: &circuitBreaker{
+			threshold: c.Classifier.BreakerThreshold,
+			cooldown:  c.Classifier.BreakerCooldown,
+		},
+		http: &http.Client{},
+	}
+}
+
+// classify requests a notification score for a post.
+func (c *classifierClient) classify(ctx context.Context, post streamablePost) (classificationResult, error) {
+	params := url.Values{}
+	params.Add("id", post.getID())
+	params.Add("site", post.siteName())
+
+	var result classificationResult
+	err := c.get(ctx, "/classify", params, c.timeout, c.retries, &result)
+	if err != nil {
+		return result, err
+	}
+	if !result.Success {
+		return result, classifierResponseError{Type: result.Error, Description: result.ErrorDescription}
+	}
+	return result, nil
+}
+
+// classifyBatch requests notification scores for several posts from one site in a single request.
+// Results are keyed by post id. A post the classifier couldn't score has a result with Success set to false.
+func (c *classifierClient) classifyBatch(ctx context.Context, site string, ids []string) (map[string]classificationResult, error) {
+	params := url.Values{}
+	params.Add("ids", strings.Join(ids, ","))
+	params.Add("site", site)
+
+	var response struct {
+		Success          bool
+		Error            string
+		ErrorDescription string `json:"error_description"`
+		Results          []classificationResult
+	}
+	err := c.get(ctx, "/classify", params, c.timeout, c.retries, &response)
+	if err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, classifierResponseError{Type: response.Error, Description: response.ErrorDescription}
+	}
+
+	results := make(map[string]classificationResult, len(response.Results))
+	for _, result := range response.Results {
+		results[result.ID] = result
+	}
+	return results, nil
+}
+
+// retrain rebuilds a site's model from the latest labels. Site may be "all".
+// Retraining is slow, so it has its own timeout and isn't retried.
+func (c *classifierClient) retrain(ctx context.Context, site string) error {
+	params := url.Values{}
+	params.Add("site", site)
+
+	var result struct {
+		Success bool
+		Error   string
+	}
+	err := c.get(ctx, "/retrain", params, c.retrainTimeout, 0, &result)
+	if err != nil {
+		return err
+	}
+	if !result.Success {
+		return classifierResponseError{Type: result.Error}
+	}
+	return nil
+}
+
+// stats gets a printable summary of a site's model. Site may be "all".
+func (c *classifierClient) stats(ctx context.Context, site string) (string, error) {
+	params := url.Values{}
+	params.Add("site", site)
+
+	var result struct {
+		Success    bool
+		Statistics string
+		Error      string
+	}
+	err := c.get(ctx, "/stats", params, c.timeout, c.retries, &result)
+	if err != nil {
+		return "", err
+	}
+	if !result.Success {
+		return "", classifierResponseError{Type: result.Error}
+	}
+	return result.Statistics, nil
+}
+
+// label gets the ids of count posts that would best improve a site's model if labelled.
+func (c *classifierClient) label(ctx context.Context, site string, count int) ([]string, error) {
+	params := url.Values{}
+	params.Add("site", site)
+	params.Add("count", strconv.Itoa(count))
+
+	var result struct {
+		Success          bool
+		Error            string
+		ErrorDescription string `json:"error_description"`
+		IDs              []string
+	}
+	err := c.get(ctx, "/label", params, c.timeout, c.retries, &result)
+	if err != nil {
+		return nil, err
+	}
+	if !result.Success {
+		return nil, classifierResponseError{Type: result.Error, Description: result.ErrorDescription}
+	}
+	return result.IDs, nil
+}
+
+// status probes the classifier's health. A successful probe closes the circuit breaker.
+func (c *classifierClient) status(ctx context.Context) error {
+	err := c.getOnce(ctx, "/status", nil, c.timeout, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errClassifierUnavailable, err)
+	}
+	c.breaker.success()
+	return nil
+}
+
+// get sends a GET request to the classifier and decodes the JSON response into result.
+// Network errors and server errors are retried with exponential backoff, and recorded by the circuit breaker.
+// Client errors and undecodable responses come from a running classifier, so they're returned as they are.
+func (c *classifierClient) get(ctx context.Context, path string, params url.Values, timeout time.Duration, retries int, result interface{}) error {
+	if !c.breaker.allow() {
+		return errCircuitOpen
+	}
+
+	var err error
+	backoff := c.retryBackoff
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		err = c.getOnce(ctx, path, params, timeout, result)
+		if err == nil {
+			c.breaker.success()
+			return nil
+		}
+		// Cancellation is our choice, not a classifier failure.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var status statusError
+		if (errors.As(err, &status) && status.code < 500) || errors.Is(err, errBadResponse) {
+			return err
+		}
+	}
+
+	c.breaker.failure()
+	return fmt.Errorf("%w: %s", errClassifierUnavailable, err)
+}
+
+// statusError is returned when the classifier or an API responds with an unexpected status.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.status)
+}
+
+// getOnce sends a single GET request. If result is nil, the response body is ignored.
+func (c *classifierClient) getOnce(ctx context.Context, path string, params url.Values, timeout time.Duration, result interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	requestURL := c.baseURL + path
+	if len(params) > 0 {
+		requestURL = fmt.Sprintf("%s?%s", requestURL, params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	if result == nil {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errBadResponse, err)
+	}
+	return nil
+}
+
+// circuitBreaker stops requests to the classifier after repeated failures, so the pipeline doesn't wait on timeouts.
+// Once open, a single trial request is let through every cooldown period, and a success closes it again.
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int           // Consecutive failures before opening.
+	cooldown  time.Duration // Time between trial requests while open.
+	failures  int
+	lastTrial time.Time
+}
+
+// allow reports whether a request may be sent.
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Since(b.lastTrial) >= b.cooldown {
+		b.lastTrial = time.Now()
+		return true
+	}
+	return false
+}
+
+func (b *circuitBreaker) success() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures = 0
+}
+
+func (b *circuitBreaker) failure() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures++
+	if b.failures >= b.threshold {
+		b.lastTrial = time.Now()
+	}
+}
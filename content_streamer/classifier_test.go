@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClassifierGetErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		requests    int  // Requests sent, including retries.
+		fails       bool // Whether an error is returned.
+		unavailable bool // Whether the error is errClassifierUnavailable, and counted by the breaker.
+	}{
+		{"ok", http.StatusOK, `{"Success":true}`, 1, false, false},
+		{"client error", http.StatusBadRequest, `{}`, 1, true, false},
+		{"not found", http.StatusNotFound, `{}`, 1, true, false},
+		{"bad json", http.StatusOK, `{"Success":`, 1, true, false},
+		{"server error", http.StatusInternalServerError, `{}`, 3, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer server.Close()
+
+			c := defaultConfig()
+			c.Classifier.URL = server.URL
+			c.Classifier.RetryBackoff = time.Millisecond
+			c.Classifier.BreakerThreshold = 1
+			client := newClassifierClient(c)
+
+			var result struct{ Success bool }
+			err := client.get(context.Background(), "/classify", nil, time.Second, 2, &result)
+			if (err != nil) != test.fails {
+				t.Fatalf("got error %v, want failure to be %v", err, test.fails)
+			}
+			if errors.Is(err, errClassifierUnavailable) != test.unavailable {
+				t.Errorf("got error %v, want unavailable to be %v", err, test.unavailable)
+			}
+			if requests != test.requests {
+				t.Errorf("sent %d requests, want %d", requests, test.requests)
+			}
+			if client.breaker.allow() == test.unavailable {
+				t.Errorf("breaker open is %v, want %v", !test.unavailable, test.unavailable)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, cooldown: time.Hour}
+	b.failure()
+	if !b.allow() {
+		t.Fatal("breaker opened before reaching the threshold")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatal("breaker still closed after reaching the threshold")
+	}
+
+	// Once the cooldown passes, one trial request is let through.
+	b.lastTrial = time.Now().Add(-2 * time.Hour)
+	if !b.allow() {
+		t.Fatal("no trial request after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("more than one trial request in a cooldown")
+	}
+	b.success()
+	if !b.allow() {
+		t.Fatal("breaker still open after a success")
+	}
+}
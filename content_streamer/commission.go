@@ -0,0 +1,504 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commissionDetails are the commission terms found in a post's text, so posts can be triaged from the notification.
+// Each field is left empty if the post doesn't mention it.
+type commissionDetails struct {
+	Status       string            `bson:"status,omitempty"` // "open" or "closed".
+	Prices       []commissionPrice `bson:"prices,omitempty"`
+	Slots        int               `bson:"slots,omitempty"`       // Number of slots mentioned, e.g. 3 in "3/5 slots".
+	SlotsTotal   int               `bson:"slots_total,omitempty"` // Total slots, e.g. 5 in "3/5 slots".
+	Deadline     time.Time         `bson:"deadline,omitempty"`    // End of the day the post says it closes.
+	DeadlineText string            `bson:"deadline_text,omitempty"`
+	Payment      []string          `bson:"payment,omitempty"` // Payment methods, e.g. PayPal.
+	Contact      []string          `bson:"contact,omitempty"` // How to order, e.g. notes.
+}
+
+type commissionPrice struct {
+	Amount   float64 `bson:"amount"`
+	Currency string  `bson:"currency"` // ISO code, or "points" for DeviantArt points.
+}
+
+func (p commissionPrice) String() string {
+	if p.Currency == "points" {
+		return fmt.Sprintf("%g points", p.Amount)
+	}
+	return fmt.Sprintf("%.2f %s", p.Amount, p.Currency)
+}
+
+// Amounts are written like 30, 12.50, 1,500 or 12,50.
+const amountPattern = `(\d{1,3}(?:,\d{3})+|\d+,\d{2}\b|\d+)(?:\.(\d{1,2}))?`
+
+// statusSubject matches what a commission status is given for.
+const statusSubject = `(?:commissions?|comms?|ychs?|slots?|adopts?|adoptables?)`
+
+var (
+	// "open species" and "closed species" are kinds of adoptable character, not commission statuses.
+	speciesPattern = regexp.MustCompile(`(?i)\b(?:open|closed|semi-open)\s+species\b`)
+	// A status only counts next to what's open or closed, as in "commissions: open" or "open for YCHs", so "open to offers" isn't one.
+	statusAfterPattern  = regexp.MustCompile(`(?i)\b` + statusSubject + `\b(?:\s+status)?[\s:!-]*(?:(?:are|is|now|currently|still|temporarily)\s+)*(not\s+|no\s+longer\s+)?(open|opened|closed|full|sold\s+out)\b`)
+	statusBeforePattern = regexp.MustCompile(`(?i)\b(open|opened|closed)\s+(?:for\s+)?(?:\w+\s+)?` + statusSubject + `\b`)
+	soldOutPattern      = regexp.MustCompile(`(?i)\bsold\s+out\b`)
+
+	symbolPricePattern = regexp.MustCompile(`(?i)(us|au|a|ca|c|nz)?([$€£¥])\s?` + amountPattern)
+	suffixPricePattern = regexp.MustCompile(`(?i)` + amountPattern + `\s?(usd|eur|gbp|aud|cad|nzd|jpy|[$€£¥])`)
+	codePricePattern   = regexp.MustCompile(`(?i)\b(usd|eur|gbp|aud|cad|nzd|jpy)\s?` + amountPattern)
+	pointsPattern      = regexp.MustCompile(`(?i)` + amountPattern + `\s?(?:points|pts|pt)\b`)
+
+	slotsOfPattern    = regexp.MustCompile(`(?i)\b(\d+)\s*(?:/|of|out\s+of)\s*(\d+)\s+(?:\w+\s+)?slots?\b`)
+	slotsAfterPattern = regexp.MustCompile(`(?i)\bslots?\s*(?:left|open|available|remaining)?\s*[:=-]\s*(\d+)(?:\s*/\s*(\d+))?`)
+	slotsPattern      = regexp.MustCompile(`(?i)\b(\d+)\s+(?:\w+\s+)?slots?\b`)
+
+	deadlineKeywordPattern = regexp.MustCompile(`(?i)\b(?:deadline|ends?|ending|closes?|closing|until|till|due)\b\s*(?:is\s+|on\s+|at\s+|:\s*)?`)
+	isoDatePattern         = regexp.MustCompile(`^(\d{4})-(\d{1,2})-(\d{1,2})`)
+	dayMonthPattern        = regexp.MustCompile(`(?i)^(?:the\s+)?(\d{1,2})(?:st|nd|rd|th)?\s+(?:of\s+)?([a-z]{3,9})\.?(?:,?\s+(\d{4}))?`)
+	monthDayPattern        = regexp.MustCompile(`(?i)^([a-z]{3,9})\.?\s+(\d{1,2})(?:st|nd|rd|th)?(?:,?\s+(\d{4}))?`)
+	ordinalDayPattern      = regexp.MustCompile(`(?i)^(?:the\s+)?(\d{1,2})(?:st|nd|rd|th)\b`)
+	relativeDatePattern    = regexp.MustCompile(`(?i)^(?:in\s+)?(\d+)\s+(hours?|days?|weeks?)`)
+	weekdayPattern         = regexp.MustCompile(`(?i)^(?:this\s+|next\s+)?([a-z]{3,9})\b\.?`)
+	clockPattern           = regexp.MustCompile(`(?i)^\s*,?\s*(?:at\s+|@\s*)?(\d{1,2})(?::(\d{2}))?\s*(am|pm)?\b`)
+	zonePattern            = regexp.MustCompile(`(?i)^\s*\(?([a-z]{3,4})\b\)?`)
+)
+
+// parseMonth reads a month's name, or an abbreviation of at least three letters.
+func parseMonth(word string) (time.Month, bool) {
+	word = strings.ToLower(word)
+	for month := time.January; month <= time.December; month++ {
+		if strings.HasPrefix(strings.ToLower(month.String()), word) {
+			return month, true
+		}
+	}
+	return 0, false
+}
+
+// paymentMethods and contactMethods map each method's name to the words that mention it.
+var paymentMethods = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"PayPal", regexp.MustCompile(`(?i)\bpay\s?pal\b`)},
+	{"Ko-fi", regexp.MustCompile(`(?i)\bko-?fi\b`)},
+	{"Venmo", regexp.MustCompile(`(?i)\bvenmo\b`)},
+	{"Cash App", regexp.MustCompile(`(?i)\bcash\s?app\b`)},
+	{"Stripe", regexp.MustCompile(`(?i)\bstripe\b`)},
+	{"Wise", regexp.MustCompile(`(?i)\b(?:wise|transferwise)\b`)},
+	{"bank transfer", regexp.MustCompile(`(?i)\bbank\s+transfer\b`)},
+	{"Patreon", regexp.MustCompile(`(?i)\bpatreon\b`)},
+	{"Gumroad", regexp.MustCompile(`(?i)\bgumroad\b`)},
+	{"points", regexp.MustCompile(`(?i)\b(?:points|pts)\b`)},
+}
+
+var contactMethods = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"notes", regexp.MustCompile(`(?i)\b(?:note\s+me|send\s+(?:me\s+)?a\s+note|via\s+notes?|through\s+notes?)\b`)},
+	{"DMs", regexp.MustCompile(`(?i)\b(?:dm|pm|dms|pms|direct\s+message|message\s+me)\b`)},
+	{"comments", regexp.MustCompile(`(?i)\b(?:comment\s+(?:below|here|on)|leave\s+a\s+comment)\b`)},
+	{"email", regexp.MustCompile(`(?i)\be-?mail\b`)},
+	{"Discord", regexp.MustCompile(`(?i)\bdiscord\b`)},
+	{"form", regexp.MustCompile(`(?i)\b(?:google\s+)?form\b`)},
+}
+
+// extractCommission finds the commission details in a post's text. Dates without a year, and relative dates, are taken from published.
+// It returns nil if the text mentions none.
+func extractCommission(text string, published time.Time) *commissionDetails {
+	details := commissionDetails{}
+	text = speciesPattern.ReplaceAllString(text, "")
+
+	details.Status = extractStatus(text)
+	details.Prices = extractPrices(text)
+	details.Slots, details.SlotsTotal = extractSlots(text)
+	details.Deadline, details.DeadlineText = extractDeadline(text, published)
+
+	for _, method := range paymentMethods {
+		if method.pattern.MatchString(text) {
+			details.Payment = append(details.Payment, method.name)
+		}
+	}
+	for _, method := range contactMethods {
+		if method.pattern.MatchString(text) {
+			details.Contact = append(details.Contact, method.name)
+		}
+	}
+
+	if details.Status == "" && len(details.Prices) == 0 && details.Slots == 0 && details.Deadline.IsZero() &&
+		len(details.Payment) == 0 && len(details.Contact) == 0 {
+		return nil
+	}
+	return &details
+}
+
+// extractStatus finds whether a post's text says commissions are "open" or "closed", or returns "" if it doesn't say.
+// The last mention wins, as artists tend to add updates such as "EDIT: closed" or "EDIT: open again" to the end.
+func extractStatus(text string) string {
+	status := ""
+	last := -1
+	// mention records a status if it's given later in the text than the last one found.
+	mention := func(at int, s string) {
+		if at > last {
+			status = s
+			last = at
+		}
+	}
+	for _, m := range statusAfterPattern.FindAllStringSubmatchIndex(text, -1) {
+		if m[2] != -1 || !strings.HasPrefix(strings.ToLower(text[m[4]:m[5]]), "open") {
+			mention(m[4], "closed")
+		} else {
+			mention(m[4], "open")
+		}
+	}
+	for _, m := range statusBeforePattern.FindAllStringSubmatchIndex(text, -1) {
+		if strings.ToLower(text[m[2]:m[3]]) == "closed" {
+			mention(m[2], "closed")
+		} else {
+			mention(m[2], "open")
+		}
+	}
+	for _, m := range soldOutPattern.FindAllStringIndex(text, -1) {
+		mention(m[0], "closed")
+	}
+	return status
+}
+
+// parseAmount reads an amount matched by amountPattern from its whole and fractional parts.
+func parseAmount(whole string, fraction string) (float64, bool) {
+	if strings.Count(whole, ",") == 1 && len(whole)-strings.Index(whole, ",") == 3 && fraction == "" {
+		// A decimal comma, as in 12,50.
+		whole = strings.Replace(whole, ",", ".", 1)
+	} else {
+		whole = strings.ReplaceAll(whole, ",", "")
+	}
+	if fraction != "" {
+		whole += "." + fraction
+	}
+	amount, err := strconv.ParseFloat(whole, 64)
+	return amount, err == nil && amount > 0
+}
+
+func currencyCode(prefix string, symbol string) string {
+	switch strings.ToLower(symbol) {
+	case "€", "eur":
+		return "EUR"
+	case "£", "gbp":
+		return "GBP"
+	case "¥", "jpy":
+		return "JPY"
+	case "usd", "aud", "cad", "nzd":
+		return strings.ToUpper(symbol)
+	}
+	switch strings.ToLower(prefix) {
+	case "au", "a":
+		return "AUD"
+	case "ca", "c":
+		return "CAD"
+	case "nz":
+		return "NZD"
+	}
+	return "USD"
+}
+
+// extractPrices finds the prices in a post's text, in the order they're written, without repeats.
+func extractPrices(text string) []commissionPrice {
+	type found struct {
+		at    int
+		price commissionPrice
+	}
+	var prices []found
+	add := func(at int, amount string, fraction string, currency string) {
+		value, ok := parseAmount(amount, fraction)
+		if ok {
+			prices = append(prices, found{at, commissionPrice{Amount: value, Currency: currency}})
+		}
+	}
+
+	for _, m := range symbolPricePattern.FindAllStringSubmatchIndex(text, -1) {
+		add(m[0], text[m[6]:m[7]], submatch(text, m, 4), currencyCode(submatch(text, m, 1), text[m[4]:m[5]]))
+	}
+	for _, m := range suffixPricePattern.FindAllStringSubmatchIndex(text, -1) {
+		add(m[0], text[m[2]:m[3]], submatch(text, m, 2), currencyCode("", text[m[6]:m[7]]))
+	}
+	for _, m := range codePricePattern.FindAllStringSubmatchIndex(text, -1) {
+		add(m[0], text[m[4]:m[5]], submatch(text, m, 3), currencyCode("", text[m[2]:m[3]]))
+	}
+	for _, m := range pointsPattern.FindAllStringSubmatchIndex(text, -1) {
+		add(m[0], text[m[2]:m[3]], submatch(text, m, 2), "points")
+	}
+
+	// Order by position, dropping repeats, such as "$30 USD" matching two patterns.
+	sort.SliceStable(prices, func(i, j int) bool {
+		return prices[i].at < prices[j].at
+	})
+	var result []commissionPrice
+	seen := make(map[commissionPrice]bool)
+	for _, p := range prices {
+		if !seen[p.price] {
+			seen[p.price] = true
+			result = append(result, p.price)
+		}
+	}
+	return result
+}
+
+// submatch returns the nth group of a match from FindAllStringSubmatchIndex, or "" if it didn't take part.
+func submatch(text string, match []int, n int) string {
+	start, end := match[2*n], match[2*n+1]
+	if start < 0 {
+		return ""
+	}
+	return text[start:end]
+}
+
+// extractSlots finds the number of slots, and the total if given, e.g. 3 and 5 from "3/5 slots".
+func extractSlots(text string) (int, int) {
+	for _, pattern := range []*regexp.Regexp{slotsOfPattern, slotsAfterPattern, slotsPattern} {
+		m := pattern.FindStringSubmatch(text)
+		if m == nil {
+			continue
+		}
+		slots, _ := strconv.Atoi(m[1])
+		total := 0
+		if len(m) > 2 {
+			total, _ = strconv.Atoi(m[2])
+		}
+		return slots, total
+	}
+	return 0, 0
+}
+
+// extractDeadline finds a date following a word such as "deadline" or "until", returning the end of that day and the text it was read from.
+func extractDeadline(text string, published time.Time) (time.Time, string) {
+	for _, m := range deadlineKeywordPattern.FindAllStringIndex(text, -1) {
+		rest := text[m[1]:]
+		if deadline, length, ok := parseDeadline(rest, published); ok {
+			return deadline, strings.TrimSpace(rest[:length])
+		}
+	}
+	return time.Time{}, ""
+}
+
+// parseDeadline reads a date and time at the start of text, returning it and the length of text it took up.
+// Dates without a time are taken as the end of the day. Days of the week, days of the month such as "the 5th", dates without a year, and times alone
+// are the next one after the post was published.
+func parseDeadline(text string, published time.Time) (time.Time, int, bool) {
+	published = published.UTC()
+
+	if m := relativeDatePattern.FindStringSubmatch(text); m != nil {
+		amount, _ := strconv.Atoi(m[1])
+		unit := time.Hour
+		switch strings.ToLower(m[2])[0] {
+		case 'd':
+			unit = 24 * time.Hour
+		case 'w':
+			unit = 7 * 24 * time.Hour
+		}
+		return published.Add(time.Duration(amount) * unit), len(m[0]), true
+	}
+
+	year, month, day, length, rollover, ok := parseDate(text, published)
+	hour, minute, zone, clockLength, hasClock := parseClock(text[length:])
+	if !ok {
+		if !hasClock {
+			return time.Time{}, 0, false
+		}
+		year, month, day = published.Date()
+		rollover = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	}
+
+	location := time.UTC
+	if zone != nil {
+		location = zone
+	}
+	deadline := time.Date(year, month, day, 23, 59, 59, 0, location)
+	if hasClock {
+		deadline = time.Date(year, month, day, hour, minute, 0, 0, location)
+	}
+	if rollover != nil && !deadline.After(published) {
+		deadline = rollover(deadline)
+	}
+	return deadline, length + clockLength, true
+}
+
+// parseDate reads a date at the start of text. rollover moves the date to its next occurrence if it's before published, and is nil for a full date.
+func parseDate(text string, published time.Time) (year int, month time.Month, day int, length int, rollover func(time.Time) time.Time, ok bool) {
+	if m := isoDatePattern.FindStringSubmatch(text); m != nil {
+		year, _ = strconv.Atoi(m[1])
+		monthNumber, _ := strconv.Atoi(m[2])
+		day, _ = strconv.Atoi(m[3])
+		if monthNumber >= 1 && monthNumber <= 12 && day >= 1 && day <= 31 {
+			return year, time.Month(monthNumber), day, len(m[0]), nil, true
+		}
+	}
+
+	var dayText, monthText, yearText string
+	if m := dayMonthPattern.FindStringSubmatch(text); m != nil {
+		dayText, monthText, yearText, length = m[1], m[2], m[3], len(m[0])
+	} else if m := monthDayPattern.FindStringSubmatch(text); m != nil {
+		dayText, monthText, yearText, length = m[2], m[1], m[3], len(m[0])
+	}
+	if monthText != "" {
+		month, monthOK := parseMonth(monthText)
+		day, _ = strconv.Atoi(dayText)
+		if monthOK && day >= 1 && day <= 31 {
+			if yearText != "" {
+				year, _ = strconv.Atoi(yearText)
+				return year, month, day, length, nil, true
+			}
+			return published.Year(), month, day, length, func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }, true
+		}
+	}
+
+	if m := ordinalDayPattern.FindStringSubmatch(text); m != nil {
+		day, _ = strconv.Atoi(m[1])
+		if day >= 1 && day <= 31 {
+			// The first month from when it was published that has the day, as there's no 31st of April.
+			for months := 0; ; months++ {
+				first := time.Date(published.Year(), published.Month()+time.Month(months), 1, 0, 0, 0, 0, time.UTC)
+				if first.AddDate(0, 0, day-1).Day() == day {
+					return first.Year(), first.Month(), day, len(m[0]), nextMonthWithDay, true
+				}
+			}
+		}
+	}
+
+	if m := weekdayPattern.FindStringSubmatch(text); m != nil {
+		switch word := strings.ToLower(m[1]); word {
+		case "today", "tonight":
+			year, month, day = published.Date()
+			return year, month, day, len(m[0]), nil, true
+		case "tomorrow":
+			year, month, day = published.AddDate(0, 0, 1).Date()
+			return year, month, day, len(m[0]), nil, true
+		default:
+			if weekday, weekdayOK := parseWeekday(word); weekdayOK {
+				year, month, day = published.AddDate(0, 0, (int(weekday)-int(published.Weekday())+7)%7).Date()
+				return year, month, day, len(m[0]), func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }, true
+			}
+		}
+	}
+	return 0, 0, 0, 0, nil, false
+}
+
+// nextMonthWithDay moves a date to the same day of the next month that has it.
+func nextMonthWithDay(t time.Time) time.Time {
+	for months := 1; ; months++ {
+		next := t.AddDate(0, months, 0)
+		if next.Day() == t.Day() {
+			return next
+		}
+	}
+}
+
+// parseClock reads a time of day at the start of text, such as "8pm", "20:00" or "8:30 pm EST", with its time zone if given.
+func parseClock(text string) (hour int, minute int, zone *time.Location, length int, ok bool) {
+	m := clockPattern.FindStringSubmatch(text)
+	if m == nil || (m[2] == "" && m[3] == "") {
+		// A number alone isn't a time.
+		return 0, 0, nil, 0, false
+	}
+	hour, _ = strconv.Atoi(m[1])
+	minute, _ = strconv.Atoi(m[2])
+	switch strings.ToLower(m[3]) {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+	if hour > 23 || minute > 59 {
+		return 0, 0, nil, 0, false
+	}
+	length = len(m[0])
+
+	if z := zonePattern.FindStringSubmatch(text[length:]); z != nil {
+		if offset, known := zoneOffsets[strings.ToUpper(z[1])]; known {
+			zone = time.FixedZone(strings.ToUpper(z[1]), offset*3600)
+			length += len(z[0])
+		}
+	}
+	return hour, minute, zone, length, true
+}
+
+// zoneOffsets are the hours ahead of UTC of the time zones artists commonly write.
+var zoneOffsets = map[string]int{
+	"UTC": 0, "GMT": 0, "BST": 1, "CET": 1, "CEST": 2,
+	"EST": -5, "EDT": -4, "CST": -6, "CDT": -5, "MST": -7, "MDT": -6, "PST": -8, "PDT": -7,
+	"JST": 9, "AEST": 10, "AEDT": 11,
+}
+
+// parseWeekday reads a day of the week's name, or an abbreviation of at least three letters.
+func parseWeekday(word string) (time.Weekday, bool) {
+	word = strings.ToLower(word)
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		if strings.HasPrefix(strings.ToLower(weekday.String()), word) {
+			return weekday, true
+		}
+	}
+	return 0, false
+}
+
+// formatCommission lists a post's commission details for its notification, one per line. It returns "" if there are none.
+func formatCommission(details *commissionDetails) string {
+	if details == nil {
+		return ""
+	}
+	var lines []string
+
+	var status []string
+	if details.Status != "" {
+		status = append(status, details.Status)
+	}
+	if details.SlotsTotal > 0 {
+		status = append(status, fmt.Sprintf("%d/%d slots", details.Slots, details.SlotsTotal))
+	} else if details.Slots > 0 {
+		status = append(status, fmt.Sprintf("%d slots", details.Slots))
+	}
+	if len(status) > 0 {
+		lines = append(lines, "Commissions: "+strings.Join(status, ", "))
+	}
+
+	if len(details.Prices) > 0 {
+		prices := make([]string, 0, len(details.Prices))
+		for _, price := range details.Prices {
+			prices = append(prices, price.String())
+		}
+		lines = append(lines, "Prices: "+strings.Join(prices, ", "))
+	}
+	if !details.Deadline.IsZero() {
+		lines = append(lines, fmt.Sprintf("Deadline: %s (\"%s\")", details.Deadline.Format("2 Jan 2006"), details.DeadlineText))
+	}
+	if len(details.Payment) > 0 {
+		lines = append(lines, "Payment: "+strings.Join(details.Payment, ", "))
+	}
+	if len(details.Contact) > 0 {
+		lines = append(lines, "Contact: "+strings.Join(details.Contact, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// postCommission returns a post's commission details, as stored when it was downloaded.
+// Posts stored before their details were kept have them extracted from their text.
+func postCommission(post streamablePost) *commissionDetails {
+	switch p := post.(type) {
+	case deviation:
+		if p.Commission != nil {
+			return p.Commission
+		}
+	case tweet:
+		if p.Commission != nil {
+			return p.Commission
+		}
+	}
+	return extractCommission(strings.Join(post.filterFields().Text, "\n"), time.Now())
+}
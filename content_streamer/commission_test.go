@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExtractStatus(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Commissions open!", "open"},
+		{"COMMISSIONS ARE NOW OPEN", "open"},
+		{"Commission status: open", "open"},
+		{"YCH - open", "open"},
+		{"3 slots open", "open"},
+		{"Open for commissions", "open"},
+		{"open ych, 5 slots", "open"},
+		{"Commissions closed. Open again soon", "closed"},
+		{"Commissions open! EDIT: commissions closed", "closed"},
+		{"Commissions closed. EDIT: commissions are open again", "open"},
+		{"Closed for commissions until May, then open for YCHs", "open"},
+		{"Open for YCHs! Update: YCHs sold out", "closed"},
+		{"closed commissions, sorry", "closed"},
+		{"comms are not open right now", "closed"},
+		{"Slots: full", "closed"},
+		{"Adopt batch SOLD OUT", "closed"},
+		{"Open species adopts, closed species not allowed", ""},
+		{"Open to offers", ""},
+		{"Keep your eyes open", ""},
+		{"The shop opened today", ""},
+		{"No status here", ""},
+	}
+	for _, test := range tests {
+		if got := extractStatus(speciesPattern.ReplaceAllString(test.text, "")); got != test.want {
+			t.Errorf("extractStatus(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestExtractDeadline(t *testing.T) {
+	// A Wednesday.
+	published := time.Date(2026, time.October, 14, 12, 0, 0, 0, time.UTC)
+	endOf := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 23, 59, 59, 0, time.UTC)
+	}
+	est := time.FixedZone("EST", -5*3600)
+
+	tests := []struct {
+		text      string
+		published time.Time // The published time above if zero.
+		want      time.Time // Zero if no deadline is found.
+		wantText  string
+	}{
+		// Full dates.
+		{"Deadline: 2026-11-02", time.Time{}, endOf(2026, time.November, 2), "2026-11-02"},
+		{"ends 5th of November 2027!", time.Time{}, endOf(2027, time.November, 5), "5th of November 2027"},
+		{"Closes Nov 5, 2027", time.Time{}, endOf(2027, time.November, 5), "Nov 5, 2027"},
+		// Dates without a year are the next one.
+		{"until the 5th of November", time.Time{}, endOf(2026, time.November, 5), "the 5th of November"},
+		{"until Oct 14", time.Time{}, endOf(2026, time.October, 14), "Oct 14"},
+		{"until Oct 13", time.Time{}, endOf(2027, time.October, 13), "Oct 13"},
+		{"until jan 3rd", time.Time{}, endOf(2027, time.January, 3), "jan 3rd"},
+		// Days of the month.
+		{"ends on the 20th", time.Time{}, endOf(2026, time.October, 20), "the 20th"},
+		{"ends on the 5th", time.Time{}, endOf(2026, time.November, 5), "the 5th"},
+		{"ends on the 14th", time.Time{}, endOf(2026, time.October, 14), "the 14th"},
+		{"ends on the 14th at 12pm", time.Time{}, time.Date(2026, time.November, 14, 12, 0, 0, 0, time.UTC), "the 14th at 12pm"},
+		{"ends the 31st", time.Date(2026, time.April, 10, 0, 0, 0, 0, time.UTC), endOf(2026, time.May, 31), "the 31st"},
+		{"ends the 31st at 9am", time.Date(2026, time.May, 31, 10, 0, 0, 0, time.UTC), time.Date(2026, time.July, 31, 9, 0, 0, 0, time.UTC), "the 31st at 9am"},
+		// Days of the week, with times and zones.
+		{"closes friday", time.Time{}, endOf(2026, time.October, 16), "friday"},
+		{"closes wed", time.Time{}, endOf(2026, time.October, 14), "wed"},
+		{"closes wednesday 9am", time.Time{}, time.Date(2026, time.October, 21, 9, 0, 0, 0, time.UTC), "wednesday 9am"},
+		{"closes wednesday at 12pm", time.Time{}, time.Date(2026, time.October, 21, 12, 0, 0, 0, time.UTC), "wednesday at 12pm"},
+		{"Deadline: Friday 8pm EST, so hurry", time.Time{}, time.Date(2026, time.October, 16, 20, 0, 0, 0, est), "Friday 8pm EST"},
+		{"deadline is next mon @ 17:30 (PST)", time.Time{}, time.Date(2026, time.October, 19, 17, 30, 0, 0, time.FixedZone("PST", -8*3600)), "next mon @ 17:30 (PST)"},
+		{"closing tomorrow", time.Time{}, endOf(2026, time.October, 15), "tomorrow"},
+		{"ending tonight at 11pm", time.Time{}, time.Date(2026, time.October, 14, 23, 0, 0, 0, time.UTC), "tonight at 11pm"},
+		// Times alone are the next one.
+		{"open until 8:30 pm EST", time.Time{}, time.Date(2026, time.October, 14, 20, 30, 0, 0, est), "8:30 pm EST"},
+		{"open until 10am", time.Time{}, time.Date(2026, time.October, 15, 10, 0, 0, 0, time.UTC), "10am"},
+		{"open until 12pm", time.Time{}, time.Date(2026, time.October, 15, 12, 0, 0, 0, time.UTC), "12pm"},
+		{"open until 13:00", time.Time{}, time.Date(2026, time.October, 14, 13, 0, 0, 0, time.UTC), "13:00"},
+		// Relative dates.
+		{"ends in 3 days", time.Time{}, time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC), "in 3 days"},
+		{"due 2 weeks", time.Time{}, time.Date(2026, time.October, 28, 12, 0, 0, 0, time.UTC), "2 weeks"},
+		// No deadline.
+		{"open until further notice", time.Time{}, time.Time{}, ""},
+		{"ends soon", time.Time{}, time.Time{}, ""},
+		{"until 5 slots are taken", time.Time{}, time.Time{}, ""},
+		{"ends the 35th", time.Time{}, time.Time{}, ""},
+		{"ends Smarch 3", time.Time{}, time.Time{}, ""},
+		{"the 5th of November", time.Time{}, time.Time{}, ""},
+	}
+	for _, test := range tests {
+		from := test.published
+		if from.IsZero() {
+			from = published
+		}
+		got, text := extractDeadline(test.text, from)
+		if !got.Equal(test.want) || text != test.wantText {
+			t.Errorf("extractDeadline(%q) = %s %q, want %s %q", test.text, got, text, test.want, test.wantText)
+		}
+	}
+}
+
+func TestExtractCommission(t *testing.T) {
+	published := time.Date(2026, time.October, 14, 12, 0, 0, 0, time.UTC)
+	details := extractCommission("YCH open! 2/5 slots. Base $30, extra character 12,50€ or 500 pts. Pay with PayPal, note me. Ends friday.", published)
+	if details == nil {
+		t.Fatal("found no details")
+	}
+	got := fmt.Sprintf("%s %d/%d %v %s %v %v", details.Status, details.Slots, details.SlotsTotal, details.Prices, details.Deadline.Format("2006-01-02"), details.Payment, details.Contact)
+	want := "open 2/5 [30.00 USD 12.50 EUR 500 points] 2026-10-16 [PayPal points] [notes]"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if details := extractCommission("Just a sketch of my cat, eyes open.", published); details != nil {
+		t.Errorf("got %+v from a post without commission details, want nil", details)
+	}
+}
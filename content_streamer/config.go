@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Prefix of the environment variables that override values from the config file.
+const envPrefix = "WAGYL_"
+
+// config holds the settings loaded from the config file (keys.yaml by default).
+type config struct {
+	Telegram struct {
+		APIKey              string         `yaml:"api_key"`
+		ChatID              int64          `yaml:"chat_id"`
+		ConversationTimeout time.Duration  `yaml:"conversation_timeout"` // Time to wait for a reply in a dialogue such as /follow before cancelling it.
+		AllowedChats        []int64        `yaml:"allowed_chats"`        // Chats the bot responds in. Defaults to chat_id.
+		Users               map[int]string `yaml:"users"`                // Roles of individual users, by user id. One of admin, labeller, viewer or none.
+		DefaultRole         string         `yaml:"default_role"`         // Role of users in an allowed chat who aren't listed in users. Defaults to admin if users is empty, otherwise viewer.
+		ReminderBefore      time.Duration  `yaml:"reminder_before"`      // How long before a notified post's deadline to send it again. Zero disables reminders.
+	} `yaml:"telegram"`
+	Twitter struct {
+		BearerToken string `yaml:"bearer_token"`
+		APIURL      string `yaml:"api_url"` // Base URL of the v2 API, e.g. to point at a fake server.
+	} `yaml:"twitter"`
+	DeviantArt struct {
+		ClientID     string        `yaml:"client_id"`
+		ClientSecret string        `yaml:"client_secret"`
+		Timeout      time.Duration `yaml:"timeout"`       // Timeout of each API request.
+		Retries      int           `yaml:"retries"`       // Number of retries after a failed or rate limited request.
+		RetryBackoff time.Duration `yaml:"retry_backoff"` // Delay before the first retry. Doubles on each retry.
+		RateLimit    float64       `yaml:"rate_limit"`    // Requests per second, shared by every worker.
+		Burst        int           `yaml:"burst"`         // Requests that can be sent at once after a quiet spell.
+	} `yaml:"deviantArt"`
+	Store struct {
+		Backend string `yaml:"backend"` // One of mongo, bolt or memory.
+		Path    string `yaml:"path"`    // File used by the bolt backend.
+	} `yaml:"store"`
+	Mongo struct {
+		URI      string `yaml:"uri"`
+		Database string `yaml:"database"`
+	} `yaml:"mongo"`
+	Classifier struct {
+		URL string `yaml:"url"` // Base URL of the ml_webhooks server.
+		// Score above which a post is notified, unless overridden for its site or feed.
+		NotificationThreshold float64            `yaml:"notification_threshold"`
+		SiteThresholds        map[string]float64 `yaml:"site_thresholds"`   // Thresholds for individual sites, by site name.
+		Decision              string             `yaml:"decision"`          // How to decide whether to notify a post. One of threshold or model.
+		Timeout               time.Duration      `yaml:"timeout"`           // Timeout of each request, other than retraining.
+		RetrainTimeout        time.Duration      `yaml:"retrain_timeout"`   // Timeout of a request to retrain a model.
+		Retries               int                `yaml:"retries"`           // Number of retries after a failed request.
+		RetryBackoff          time.Duration      `yaml:"retry_backoff"`     // Delay before the first retry. Doubles on each retry.
+		BreakerThreshold      int                `yaml:"breaker_threshold"` // Consecutive failed requests before the classifier is treated as down.
+		BreakerCooldown       time.Duration      `yaml:"breaker_cooldown"`  // Time between trial requests while the classifier is down.
+		Fallback              string             `yaml:"fallback"`          // What to do with posts while the classifier is down. One of queue, notify or drop.
+		HealthInterval        time.Duration      `yaml:"health_interval"`   // Time between health probes while posts are queued.
+		MaxAttempts           int                `yaml:"max_attempts"`      // Failed classifications of a queued post before it's moved to the dead letters.
+		BatchSize             int                `yaml:"batch_size"`        // Maximum number of posts classified in one request.
+		BatchWindow           time.Duration      `yaml:"batch_window"`      // Time to wait for more posts before classifying a partial batch.
+	} `yaml:"classifier"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // Time allowed for queued posts to drain on shutdown.
+	Polling         struct {
+		Delay                    time.Duration `yaml:"delay"`                       // Time to wait between polls of a feed.
+		MaxPages                 int           `yaml:"max_pages"`                   // Maximum number of pages to download per poll. Primarily used to limit the initial feed.
+		NewFeedNotificationLimit int           `yaml:"new_feed_notification_limit"` // Number of posts to be shown when adding a new feed.
+		Jitter                   float64       `yaml:"jitter"`                      // Fraction of a feed's interval its polls are randomly moved by, so feeds don't all fall due together.
+		Workers                  int           `yaml:"workers"`                     // Number of feeds of each site polled at once.
+		Adaptive                 bool          `yaml:"adaptive"`                    // Learn how often to poll each DeviantArt feed from how often it posts. Otherwise every feed uses delay.
+		MinDelay                 time.Duration `yaml:"min_delay"`                   // Shortest time between adaptive polls of a feed, and the time between polls of a hot feed.
+		MaxDelay                 time.Duration `yaml:"max_delay"`                   // Longest time between adaptive polls of a feed.
+		RecheckInterval          time.Duration `yaml:"recheck_interval"`            // Time between re-checks of recent DeviantArt posts for edits. Zero disables re-checking.
+		RecheckWindow            time.Duration `yaml:"recheck_window"`              // How long after being published a post is re-checked for edits.
+	} `yaml:"polling"`
+}
+
+// defaultConfig returns the configuration used for any setting missing from the config file.
+func defaultConfig() config {
+	var c config
+	c.Telegram.ConversationTimeout = 10 * time.Minute
+	c.Telegram.ReminderBefore = time.Hour
+	c.Twitter.APIURL = "https://api.twitter.com/2"
+	c.DeviantArt.Timeout = 30 * time.Second
+	c.DeviantArt.Retries = 5
+	c.DeviantArt.RetryBackoff = 2 * time.Second
+	c.DeviantArt.RateLimit = 1
+	c.DeviantArt.Burst = 5
+	c.Store.Backend = "mongo"
+	c.Store.Path = "wagyl.db"
+	c.Mongo.URI = "mongodb://localhost:27017"
+	c.Mongo.Database = "adopt-detector-DB"
+	c.Classifier.URL = "http://localhost:5000"
+	c.Classifier.NotificationThreshold = -0.1
+	c.Classifier.Decision = decisionThreshold
+	c.Classifier.Timeout = 10 * time.Second
+	c.Classifier.RetrainTimeout = 10 * time.Minute
+	c.Classifier.Retries = 2
+	c.Classifier.RetryBackoff = time.Second
+	c.Classifier.BreakerThreshold = 5
+	c.Classifier.BreakerCooldown = time.Minute
+	c.Classifier.Fallback = fallbackQueue
+	c.Classifier.HealthInterval = 30 * time.Second
+	c.Classifier.MaxAttempts = 5
+	c.Classifier.BatchSize = 50
+	c.Classifier.BatchWindow = 2 * time.Second
+	c.ShutdownTimeout = 30 * time.Second
+	c.Polling.Delay = 5 * time.Minute
+	c.Polling.MaxPages = 10
+	c.Polling.NewFeedNotificationLimit = 5
+	c.Polling.Jitter = 0.1
+	c.Polling.Workers = 1
+	c.Polling.Adaptive = true
+	c.Polling.MinDelay = time.Minute
+	c.Polling.MaxDelay = time.Hour
+	c.Polling.RecheckWindow = 7 * 24 * time.Hour
+	return c
+}
+
+// loadConfig reads the config file at path, applies environment overrides and validates the result.
+func loadConfig(path string) (config, error) {
+	c := defaultConfig()
+
+	configBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("failed to read config file: %w", err)
+	}
+	// A null value in the file would clear its default rather than keep it, so drop nulls before decoding over the defaults.
+	var document yaml.MapSlice
+	err = yaml.Unmarshal(configBytes, &document)
+	if err != nil {
+		return c, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	configBytes, err = yaml.Marshal(dropNulls(document))
+	if err == nil {
+		err = yaml.Unmarshal(configBytes, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	err = c.applyEnvironment()
+	if err != nil {
+		return c, err
+	}
+
+	// Everyone is an admin until users are listed, so existing chats keep working. Once they are, the unlisted can only look.
+	if c.Telegram.DefaultRole == "" {
+		c.Telegram.DefaultRole = "viewer"
+		if len(c.Telegram.Users) == 0 {
+			c.Telegram.DefaultRole = "admin"
+		}
+	}
+
+	// Only respond in the notification chat unless told otherwise.
+	if len(c.Telegram.AllowedChats) == 0 && c.Telegram.ChatID != 0 {
+		c.Telegram.AllowedChats = []int64{c.Telegram.ChatID}
+	}
+
+	return c, c.validate()
+}
+
+// dropNulls removes the keys with null values from a YAML mapping, including nested mappings.
+func dropNulls(document yaml.MapSlice) yaml.MapSlice {
+	kept := yaml.MapSlice{}
+	for _, item := range document {
+		if item.Value == nil {
+			continue
+		}
+		if nested, ok := item.Value.(yaml.MapSlice); ok {
+			item.Value = dropNulls(nested)
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+// applyEnvironment overrides secrets and connection settings with any matching environment variables.
+func (c *config) applyEnvironment() error {
+	stringOverrides := map[string]*string{
+		"TELEGRAM_API_KEY":         &c.Telegram.APIKey,
+		"TWITTER_BEARER_TOKEN":     &c.Twitter.BearerToken,
+		"TWITTER_API_URL":          &c.Twitter.APIURL,
+		"DEVIANTART_CLIENT_ID":     &c.DeviantArt.ClientID,
+		"DEVIANTART_CLIENT_SECRET": &c.DeviantArt.ClientSecret,
+		"STORE_BACKEND":            &c.Store.Backend,
+		"STORE_PATH":               &c.Store.Path,
+		"MONGO_URI":                &c.Mongo.URI,
+		"MONGO_DATABASE":           &c.Mongo.Database,
+		"CLASSIFIER_URL":           &c.Classifier.URL,
+		"CLASSIFIER_FALLBACK":      &c.Classifier.Fallback,
+	}
+	for name, field := range stringOverrides {
+		if value, ok := os.LookupEnv(envPrefix + name); ok {
+			*field = value
+		}
+	}
+
+	if value, ok := os.LookupEnv(envPrefix + "TELEGRAM_CHAT_ID"); ok {
+		chatID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%sTELEGRAM_CHAT_ID must be an integer, got \"%s\"", envPrefix, value)
+		}
+		c.Telegram.ChatID = chatID
+	}
+
+	return nil
+}
+
+// validate checks every setting and returns an error listing each invalid field.
+func (c config) validate() error {
+	var problems []string
+
+	if c.Telegram.APIKey == "" {
+		problems = append(problems, "telegram.api_key must be set")
+	}
+	if c.Telegram.ChatID == 0 {
+		problems = append(problems, "telegram.chat_id must be set")
+	}
+	if _, ok := roleNames[c.Telegram.DefaultRole]; !ok {
+		problems = append(problems, fmt.Sprintf("telegram.default_role must be one of admin, labeller, viewer or none, got \"%s\"", c.Telegram.DefaultRole))
+	}
+	for user, name := range c.Telegram.Users {
+		if _, ok := roleNames[name]; !ok {
+			problems = append(problems, fmt.Sprintf("telegram.users has an invalid role \"%s\" for user %d", name, user))
+		}
+	}
+	if c.Telegram.ConversationTimeout <= 0 {
+		problems = append(problems, "telegram.conversation_timeout must be positive")
+	}
+	if c.Telegram.ReminderBefore < 0 {
+		problems = append(problems, "telegram.reminder_before must not be negative")
+	}
+	if (c.DeviantArt.ClientID == "") != (c.DeviantArt.ClientSecret == "") {
+		problems = append(problems, "deviantArt.client_id and deviantArt.client_secret must be set together")
+	}
+	if _, err := url.ParseRequestURI(c.Twitter.APIURL); err != nil {
+		problems = append(problems, fmt.Sprintf("twitter.api_url is not a valid URL (%s)", err))
+	}
+	switch c.Store.Backend {
+	case "mongo", "bolt", "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("store.backend must be one of mongo, bolt or memory, got \"%s\"", c.Store.Backend))
+	}
+	if c.Store.Backend == "bolt" && c.Store.Path == "" {
+		problems = append(problems, "store.path must be set for the bolt backend")
+	}
+	if c.Store.Backend == "mongo" && c.Mongo.Database == "" {
+		problems = append(problems, "mongo.database must be set")
+	}
+	if c.Store.Backend == "mongo" && !strings.HasPrefix(c.Mongo.URI, "mongodb://") && !strings.HasPrefix(c.Mongo.URI, "mongodb+srv://") {
+		problems = append(problems, "mongo.uri must start with mongodb:// or mongodb+srv://")
+	}
+	if c.DeviantArt.Timeout <= 0 || c.DeviantArt.RetryBackoff <= 0 {
+		problems = append(problems, "deviantArt timeouts and delays must be positive")
+	}
+	if c.DeviantArt.Retries < 0 {
+		problems = append(problems, "deviantArt.retries must not be negative")
+	}
+	if c.DeviantArt.RateLimit <= 0 {
+		problems = append(problems, "deviantArt.rate_limit must be positive")
+	}
+	if c.DeviantArt.Burst <= 0 {
+		problems = append(problems, "deviantArt.burst must be positive")
+	}
+	if _, err := url.ParseRequestURI(c.Classifier.URL); err != nil {
+		problems = append(problems, fmt.Sprintf("classifier.url is not a valid URL (%s)", err))
+	}
+	if c.Classifier.Timeout <= 0 || c.Classifier.RetrainTimeout <= 0 || c.Classifier.RetryBackoff <= 0 || c.Classifier.BreakerCooldown <= 0 {
+		problems = append(problems, "classifier timeouts and delays must be positive")
+	}
+	if c.Classifier.HealthInterval <= 0 {
+		problems = append(problems, "classifier.health_interval must be positive")
+	}
+	if c.Classifier.Retries < 0 {
+		problems = append(problems, "classifier.retries must not be negative")
+	}
+	if c.Classifier.MaxAttempts <= 0 {
+		problems = append(problems, "classifier.max_attempts must be positive")
+	}
+	if c.Classifier.BatchSize <= 0 || c.Classifier.BatchWindow <= 0 {
+		problems = append(problems, "classifier.batch_size and classifier.batch_window must be positive")
+	}
+	if c.Classifier.BreakerThreshold <= 0 {
+		problems = append(problems, "classifier.breaker_threshold must be positive")
+	}
+	if !validThreshold(c.Classifier.NotificationThreshold) {
+		problems = append(problems, "classifier.notification_threshold must be from 0 to 1")
+	}
+	for site, value := range c.Classifier.SiteThresholds {
+		if _, err := parseSiteName(site); err != nil {
+			problems = append(problems, fmt.Sprintf("classifier.site_thresholds has an unknown site \"%s\"", site))
+		}
+		if !validThreshold(value) {
+			problems = append(problems, fmt.Sprintf("classifier.site_thresholds for %s must be from 0 to 1", site))
+		}
+	}
+	switch c.Classifier.Decision {
+	case decisionThreshold, decisionModel:
+	default:
+		problems = append(problems, fmt.Sprintf("classifier.decision must be one of threshold or model, got \"%s\"", c.Classifier.Decision))
+	}
+	switch c.Classifier.Fallback {
+	case fallbackQueue, fallbackNotify, fallbackDrop:
+	default:
+		problems = append(problems, fmt.Sprintf("classifier.fallback must be one of queue, notify or drop, got \"%s\"", c.Classifier.Fallback))
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown_timeout must be positive")
+	}
+	if c.Polling.Delay <= 0 {
+		problems = append(problems, "polling.delay must be positive")
+	}
+	if c.Polling.MaxPages <= 0 {
+		problems = append(problems, "polling.max_pages must be positive")
+	}
+	if c.Polling.NewFeedNotificationLimit < 0 {
+		problems = append(problems, "polling.new_feed_notification_limit must not be negative")
+	}
+	if c.Polling.MinDelay <= 0 {
+		problems = append(problems, "polling.min_delay must be positive")
+	}
+	if c.Polling.MaxDelay < c.Polling.MinDelay {
+		problems = append(problems, "polling.max_delay must not be less than polling.min_delay")
+	}
+	if c.Polling.Workers <= 0 {
+		problems = append(problems, "polling.workers must be positive")
+	}
+	if c.Polling.Jitter < 0 || c.Polling.Jitter >= 1 {
+		problems = append(problems, "polling.jitter must be at least 0 and less than 1")
+	}
+	if c.Polling.RecheckInterval < 0 {
+		problems = append(problems, "polling.recheck_interval must not be negative")
+	}
+	if c.Polling.RecheckWindow <= 0 {
+		problems = append(problems, "polling.recheck_window must be positive")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
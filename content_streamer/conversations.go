@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// stepHandler handles the next message in a conversation, such as the /follow dialogue.
+// It returns the handler for the message after, or nil once the conversation is over.
+type stepHandler func(update tgbotapi.Update) stepHandler
+
+// conversationKey identifies a conversation with one user in one chat, so users can't interrupt each other's dialogues.
+type conversationKey struct {
+	chatID int64
+	userID int
+}
+
+// conversation is a dialogue waiting for a user's next message.
+type conversation struct {
+	command string // Command that started the conversation, for messages to the user.
+	next    stepHandler
+	expires time.Time
+}
+
+// Conversations in progress. Only accessed by telegramCallbackHandler, so they survive it being restarted.
+var conversations = make(map[conversationKey]conversation)
+
+// messageConversationKey returns the key of the conversation a message belongs to.
+func messageConversationKey(message *tgbotapi.Message) conversationKey {
+	key := conversationKey{chatID: message.Chat.ID}
+	// Messages posted in channels have no sender.
+	if message.From != nil {
+		key.userID = message.From.ID
+	}
+	return key
+}
+
+// startConversation waits for the user's next message in this chat to be handled by next.
+// Any conversation the user already had in the chat is replaced.
+func startConversation(key conversationKey, command string, next stepHandler) {
+	conversations[key] = conversation{
+		command: command,
+		next:    next,
+		expires: time.Now().Add(conf.Telegram.ConversationTimeout),
+	}
+}
+
+// continueConversation passes a message to the conversation waiting for it. It returns false if there isn't one.
+func continueConversation(update tgbotapi.Update) bool {
+	key := messageConversationKey(update.Message)
+	c, ok := conversations[key]
+	if !ok {
+		return false
+	}
+
+	next := c.next(update)
+	if next == nil {
+		delete(conversations, key)
+		return true
+	}
+	c.next = next
+	c.expires = time.Now().Add(conf.Telegram.ConversationTimeout)
+	conversations[key] = c
+	return true
+}
+
+// cancelConversation ends the user's conversation in a chat. It returns the command that started it, or "" if there wasn't one.
+func cancelConversation(key conversationKey) string {
+	c, ok := conversations[key]
+	if !ok {
+		return ""
+	}
+	delete(conversations, key)
+	return c.command
+}
+
+// expireConversations ends conversations that have waited too long for a reply, letting the users know.
+func expireConversations() {
+	now := time.Now()
+	for key, c := range conversations {
+		if now.Before(c.expires) {
+			continue
+		}
+		delete(conversations, key)
+		msg := tgbotapi.NewMessage(key.chatID, fmt.Sprintf("Cancelled /%s as there was no reply.", c.command))
+		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(false)
+		sendMessage(msg)
+	}
+}
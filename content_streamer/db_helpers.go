@@ -1,66 +1,112 @@
 package main
 
 import (
-	"context"
 	"errors"
 	"fmt"
-	"log"
 
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func parseSiteName(text string) (streamablePost, error) {
-	for _, site := range siteTypes {
-		if text == site.siteName() || text == site.prettySiteName() {
-			return site, nil
-		}
+// errNotFound is returned by a store when the requested document doesn't exist.
+var errNotFound = errors.New("not found in database")
+
+// store abstracts the database holding posts, feeds and labels.
+type store interface {
+	insertPost(post streamablePost, feed string) (bool, error)        // Add a post to its site's collection if it's new, reporting whether it was. Either way, feed is added to the post's feeds, unless empty.
+	postNotified(site string, id string) (bool, error)                // Report whether a post has been sent to the chat.
+	markPostNotified(site string, id string) error                    // Record that a post was sent to the chat.
+	getPost(site string, id string) (streamablePost, error)           // Get a post based on its site and id.
+	deletePost(site string, id string) error                          // Delete a post based on its site and id.
+	updatePostNotify(site string, id string, notification bool) error // Label a post with whether it should have been notified.
+	getRecentDeviations(since int64) ([]deviation, error)             // Get the DeviantArt posts published at or after a unix time.
+	addDeviationRevision(d deviation, previous dARevision) error      // Save an edited deviation's title, description, tags and commission details, keeping the previous version. Its notification is cleared so it can be sent again.
+
+	getDAFeeds() ([]dAFeed, error)                           // Get every followed DeviantArt feed.
+	insertDAFeed(feed dAFeed) error                          // Add a DeviantArt feed.
+	updateDAFeed(feed dAFeed) error                          // Save the polling state of a DeviantArt feed.
+	setDAFeedPaused(feed dAFeed, paused bool) error          // Pause or resume a DeviantArt feed.
+	deleteDAFeed(feed dAFeed) error                          // Remove a DeviantArt feed.
+	setDAFeedHot(feed dAFeed, hot bool) error                // Set whether a DeviantArt feed is always polled at the minimum delay.
+	addDAFeedPositive(feed dAFeed, at int64) error           // Record that a post from a DeviantArt feed was labelled as worth notifying.
+	getTwitterFeeds() ([]twitterFeed, error)                 // Get every followed twitter user.
+	insertTwitterFeed(feed twitterFeed) error                // Add a twitter feed.
+	updateTwitterFeed(feed twitterFeed) error                // Save the polling state of a twitter feed.
+	setTwitterFeedPaused(username string, paused bool) error // Pause or resume a twitter feed.
+	deleteTwitterFeed(username string) error                 // Remove a twitter feed.
+
+	getQueueEntry(key string) (queueEntry, error) // Get a post's entry in the notification queue.
+	getQueueEntries() ([]queueEntry, error)       // Get every entry in the notification queue, oldest first.
+	putQueueEntry(entry queueEntry) error         // Add or replace an entry in the notification queue.
+	deleteQueueEntry(key string) error            // Remove a post from the notification queue.
+
+	getThresholds() ([]threshold, error) // Get every notification threshold set from the chat.
+	putThreshold(t threshold) error      // Add or replace a notification threshold.
+	deleteThreshold(key string) error    // Remove a notification threshold.
+
+	getReminders() ([]reminder, error) // Get every scheduled deadline reminder.
+	putReminder(r reminder) error      // Add or replace a deadline reminder.
+	deleteReminder(key string) error   // Remove a deadline reminder.
+
+	getRules() ([]rule, error) // Get every filter rule.
+	putRule(r rule) error      // Add or replace a filter rule.
+	deleteRule(id int) error   // Remove a filter rule.
+
+	close() error // Release the connection to the database.
+}
+
+// openStore connects to the backend selected in the config.
+func openStore(c config) (store, error) {
+	switch c.Store.Backend {
+	case "mongo":
+		return newMongoStore(c.Mongo.URI, c.Mongo.Database)
+	case "bolt":
+		return newBoltStore(c.Store.Path)
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store backend \"%s\"", c.Store.Backend)
 	}
-	return nil, errors.New("invalid site name")
 }
 
-func getPost(site string, id string) (streamablePost, error) {
-	siteType, err := parseSiteName(site)
+// postDocument encodes a post as the document stored for it, without the fields the store keeps itself.
+func postDocument(post streamablePost) (bson.M, error) {
+	value, err := bson.Marshal(post)
 	if err != nil {
 		return nil, err
 	}
-
-	collection := database.Collection(fmt.Sprintf("%sPosts", site))
-	singleResult := collection.FindOne(
-		context.TODO(),
-		bson.M{"_id": id},
-	)
-
-	result, err := siteType.decodeDBResult(singleResult)
-
+	document := bson.M{}
+	err = bson.Unmarshal(value, &document)
 	if err != nil {
-		log.Println("got error")
 		return nil, err
 	}
+	delete(document, "feeds")
+	delete(document, "notified_at")
+	return document, nil
+}
 
-	return result, nil
+// postCollection returns the name of the collection holding a site's posts.
+func postCollection(site string) string {
+	return fmt.Sprintf("%sPosts", site)
 }
 
-// deletePost deletes a post from the database based on its site and id.
-func deletePost(site string, id string) {
-	collection := database.Collection(fmt.Sprintf("%sPosts", site))
-	_, err := collection.DeleteMany(
-		context.TODO(),
-		bson.M{"_id": id},
-	)
+// feedNames returns the names of a site's followed feeds, as set in each postMessage.
+func feedNames(site streamablePost) ([]string, error) {
+	feeds, err := site.getFeeds()
 	if err != nil {
-		log.Panicln(err)
+		return nil, err
+	}
+	names := make([]string, 0, len(feeds))
+	for _, feed := range feeds {
+		names = append(names, feed.Name)
 	}
+	return names, nil
 }
 
-// updatePostNotify sets the notify parameter of a post in the database.
-func updatePostNotify(site string, id string, notification bool) {
-	collection := database.Collection(fmt.Sprintf("%sPosts", site))
-	_, err := collection.UpdateOne(
-		context.TODO(),
-		bson.M{"_id": id},
-		bson.M{"$set": bson.M{"notify": notification}},
-	)
-	if err != nil {
-		log.Panicln(err)
+func parseSiteName(text string) (streamablePost, error) {
+	for _, site := range siteTypes {
+		if text == site.siteName() || text == site.prettySiteName() {
+			return site, nil
+		}
 	}
+	return nil, errors.New("invalid site name")
 }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dAAPIURL   = "https://www.deviantart.com/api/v1/oauth2"
+	dATokenURL = "https://www.deviantart.com/oauth2/token"
+)
+
+// dAAPIClient sends requests to the DeviantArt API. Every request shares one HTTP client and one rate limit, so the workers can't exceed it between them.
+type dAAPIClient struct {
+	baseURL      string
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	tokens       *tokenSource
+	timeout      time.Duration // Timeout of each request.
+	retries      int           // Number of retries after a failed request.
+	retryBackoff time.Duration // Delay before the first retry. Doubles on each retry.
+	limiter      *tokenBucket
+	metrics      *dAMetrics
+	http         *http.Client
+}
+
+// Global DeviantArt API client.
+var dAClient *dAAPIClient
+
+func newDAAPIClient(c config) *dAAPIClient {
+	client := &dAAPIClient{
+		baseURL:      dAAPIURL,
+		tokenURL:     dATokenURL,
+		clientID:     c.DeviantArt.ClientID,
+		clientSecret: c.DeviantArt.ClientSecret,
+		timeout:      c.DeviantArt.Timeout,
+		retries:      c.DeviantArt.Retries,
+		retryBackoff: c.DeviantArt.RetryBackoff,
+		limiter:      newTokenBucket(c.DeviantArt.RateLimit, c.DeviantArt.Burst),
+		metrics:      &dAMetrics{byStatus: make(map[int]int)},
+		http:         &http.Client{},
+	}
+	client.tokens = newTokenSource("DeviantArt", client.fetchToken)
+	return client
+}
+
+// fetchToken requests an access token with the client credentials grant.
+func (c *dAAPIClient) fetchToken(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{}
+	form.Add("grant_type", "client_credentials")
+	form.Add("client_id", c.clientID)
+	form.Add("client_secret", c.clientSecret)
+
+	// Error payloads are returned as a dAError.
+	var result dATokenResponse
+	err := c.postToken(ctx, form, &result)
+	if err != nil {
+		return "", 0, err
+	}
+	if result.AccessToken == "" {
+		return "", 0, errors.New("DeviantArt token response has no access token")
+	}
+	return result.AccessToken, time.Duration(result.ExpiresIn) * time.Second, nil
+}
+
+// get sends an authenticated GET request to an API endpoint, such as "/browse/newest", and decodes the JSON response into result.
+// If the API rejects the access token, it's refreshed and the request is sent once more.
+func (c *dAAPIClient) get(ctx context.Context, path string, params url.Values, result interface{}) error {
+	query := url.Values{}
+	for key, values := range params {
+		query[key] = values
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.tokens.get(ctx)
+		if err != nil {
+			return fmt.Errorf("no access token: %w", err)
+		}
+		query.Set("access_token", token)
+
+		err = c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s%s?%s", c.baseURL, path, query.Encode()), nil)
+		}, result)
+
+		var apiErr dAError
+		if attempt == 0 && errors.As(err, &apiErr) && apiErr.Type == "invalid_token" {
+			// The token was revoked or expired early.
+			c.tokens.invalidate(token)
+			continue
+		}
+		return err
+	}
+}
+
+// postToken sends a form to the OAuth token endpoint and decodes the JSON response into result.
+func (c *dAAPIClient) postToken(ctx context.Context, form url.Values, result interface{}) error {
+	return c.do(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", urlEncoded)
+		return req, nil
+	}, result)
+}
+
+// do sends a request built by newRequest, waiting for the rate limiter first.
+// Network errors, server errors and 429 Too Many Requests are retried with exponential backoff.
+// A Retry-After header pauses every request until it has passed.
+func (c *dAAPIClient) do(ctx context.Context, newRequest func(ctx context.Context) (*http.Request, error), result interface{}) error {
+	var err error
+	backoff := c.retryBackoff
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			c.metrics.retry()
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		waited, waitErr := c.limiter.wait(ctx)
+		c.metrics.wait(waited)
+		if waitErr != nil {
+			return waitErr
+		}
+
+		err = c.doOnce(ctx, newRequest, result)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		var limited rateLimitError
+		if errors.As(err, &limited) {
+			c.limiter.pause(time.Now().Add(limited.retryAfter))
+			continue
+		}
+		// Don't retry requests the API rejected.
+		var status statusError
+		if errors.As(err, &status) && status.code < 500 {
+			break
+		}
+		var apiErr dAError
+		if errors.As(err, &apiErr) && apiErr.Code < 500 {
+			break
+		}
+	}
+	return err
+}
+
+// rateLimitError is returned when the API responds with 429 Too Many Requests.
+type rateLimitError struct {
+	retryAfter time.Duration // Zero if the response didn't say.
+}
+
+func (e rateLimitError) Error() string {
+	if e.retryAfter == 0 {
+		return "rate limited"
+	}
+	return fmt.Sprintf("rate limited, retry after %s", e.retryAfter)
+}
+
+// doOnce sends a single request and records it in the metrics.
+func (c *dAAPIClient) doOnce(ctx context.Context, newRequest func(ctx context.Context) (*http.Request, error), result interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := newRequest(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	c.metrics.request(resp)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return rateLimitError{retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// Errors are usually sent with an error status, but check successful responses for an error payload too.
+	var apiErr dAError
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Type != "" {
+		apiErr.Code = resp.StatusCode
+		return apiErr
+	}
+	if resp.StatusCode != http.StatusOK {
+		return statusError{code: resp.StatusCode, status: resp.Status}
+	}
+
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// parseRetryAfter reads a Retry-After header, given either in seconds or as a date. It returns zero if the header is missing or invalid.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// tokenBucket limits the rate of requests. It holds up to burst tokens, refilled at rate per second, and each request takes one.
+type tokenBucket struct {
+	sync.Mutex
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time // When tokens was last refilled.
+	pausedUntil time.Time // No requests are allowed before this, after being told to back off.
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a request may be sent, returning how long it waited.
+func (b *tokenBucket) wait(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	for {
+		b.Lock()
+		now := time.Now()
+		var delay time.Duration
+		if now.Before(b.pausedUntil) {
+			delay = b.pausedUntil.Sub(now)
+		} else {
+			b.tokens += now.Sub(b.last).Seconds() * b.rate
+			if b.tokens > b.burst {
+				b.tokens = b.burst
+			}
+			b.last = now
+			if b.tokens >= 1 {
+				b.tokens--
+				b.Unlock()
+				return time.Since(start), nil
+			}
+			delay = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		}
+		b.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return time.Since(start), ctx.Err()
+		}
+	}
+}
+
+// pause stops every request until a time, and empties the bucket so requests restart slowly.
+func (b *tokenBucket) pause(until time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	if until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+	b.tokens = 0
+	if b.pausedUntil.After(b.last) {
+		b.last = b.pausedUntil
+	}
+}
+
+// dAMetrics counts the requests made to the DeviantArt API, for /status.
+type dAMetrics struct {
+	sync.Mutex
+	requests int         // Requests sent, including retries.
+	byStatus map[int]int // Responses by status code.
+	failures int         // Requests that got no response, e.g. network errors and timeouts.
+	retries  int
+	waited   time.Duration // Total time spent waiting for the rate limiter.
+}
+
+// request records a sent request and its response, which is nil if the request failed.
+func (m *dAMetrics) request(resp *http.Response) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests++
+	if resp == nil {
+		m.failures++
+		return
+	}
+	m.byStatus[resp.StatusCode]++
+}
+
+func (m *dAMetrics) retry() {
+	m.Lock()
+	defer m.Unlock()
+	m.retries++
+}
+
+func (m *dAMetrics) wait(waited time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.waited += waited
+}
+
+func (m *dAMetrics) String() string {
+	m.Lock()
+	defer m.Unlock()
+	return fmt.Sprintf("%d requests (%d OK, %d rate limited, %d other errors, %d failed to send), %d retries, %s waiting for the rate limit",
+		m.requests,
+		m.byStatus[http.StatusOK],
+		m.byStatus[http.StatusTooManyRequests],
+		m.requests-m.failures-m.byStatus[http.StatusOK]-m.byStatus[http.StatusTooManyRequests],
+		m.failures,
+		m.retries,
+		m.waited.Round(time.Second),
+	)
+}
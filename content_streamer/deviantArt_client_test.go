@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header   string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"120", 120 * time.Second, 120 * time.Second},
+		{"0", 0, 0},
+		{"-5", 0, 0},
+		{"soon", 0, 0},
+		// HTTP dates only have whole seconds.
+		{time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat), 28 * time.Second, 30 * time.Second},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, test := range tests {
+		got := parseRetryAfter(test.header)
+		if got < test.min || got > test.max {
+			t.Errorf("parseRetryAfter(%q) = %s, want between %s and %s", test.header, got, test.min, test.max)
+		}
+	}
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	b := newTokenBucket(20, 3)
+	for i := 0; i < 3; i++ {
+		waited, err := b.wait(context.Background())
+		if err != nil || waited > 10*time.Millisecond {
+			t.Fatalf("request %d within the burst waited %s, %v", i, waited, err)
+		}
+	}
+	// The fourth waits for a token, a twentieth of a second.
+	waited, err := b.wait(context.Background())
+	if err != nil || waited < 30*time.Millisecond || waited > 200*time.Millisecond {
+		t.Errorf("request after the burst waited %s, %v, want about 50ms", waited, err)
+	}
+}
+
+func TestTokenBucketPause(t *testing.T) {
+	b := newTokenBucket(1000, 5)
+	b.pause(time.Now().Add(100 * time.Millisecond))
+	// An earlier pause doesn't shorten a later one.
+	b.pause(time.Now())
+
+	waited, err := b.wait(context.Background())
+	if err != nil || waited < 90*time.Millisecond {
+		t.Errorf("request while paused waited %s, %v, want the rest of the pause", waited, err)
+	}
+}
+
+func TestTokenBucketCancel(t *testing.T) {
+	b := newTokenBucket(0.001, 1)
+	b.wait(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := b.wait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context's error", err)
+	}
+}
+
+// newTestDAClient returns a client for a fake API server, with fast retries and no rate limit to speak of.
+func newTestDAClient(server *httptest.Server) *dAAPIClient {
+	c := defaultConfig()
+	c.DeviantArt.RetryBackoff = time.Millisecond
+	c.DeviantArt.Retries = 2
+	c.DeviantArt.RateLimit = 1000
+	client := newDAAPIClient(c)
+	client.baseURL = server.URL
+	client.tokenURL = server.URL + "/token"
+	return client
+}
+
+// getFrom sends a request for path on the fake server through the client's retries and rate limit.
+func getFrom(client *dAAPIClient, path string, result interface{}) error {
+	return client.do(context.Background(), func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, client.baseURL+path, nil)
+	}, result)
+}
+
+func TestDAClientRetryAfter(t *testing.T) {
+	var times []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		times = append(times, time.Now())
+		if len(times) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"ok":true}`)
+	}))
+	defer server.Close()
+	client := newTestDAClient(server)
+
+	var result struct{ OK bool }
+	err := getFrom(client, "/browse/newest", &result)
+	if err != nil || !result.OK {
+		t.Fatalf("got %v, %+v, want the retry to succeed", err, result)
+	}
+	if len(times) != 2 {
+		t.Fatalf("sent %d requests, want 2", len(times))
+	}
+	if gap := times[1].Sub(times[0]); gap < 900*time.Millisecond {
+		t.Errorf("retried after %s, want the Retry-After of 1s", gap)
+	}
+	// Every other request waits out the pause too.
+	if !client.limiter.pausedUntil.After(times[0]) {
+		t.Error("the rate limiter wasn't paused")
+	}
+
+	if client.metrics.requests != 2 || client.metrics.byStatus[http.StatusTooManyRequests] != 1 || client.metrics.retries != 1 {
+		t.Errorf("got metrics %s, want 2 requests, 1 rate limited and 1 retry", client.metrics)
+	}
+}
+
+func TestDAClientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		requests int
+		want     string
+	}{
+		{"server error retried", http.StatusBadGateway, `bad gateway`, 3, "502"},
+		{"client error not retried", http.StatusNotFound, `not found`, 1, "404"},
+		{"api error", http.StatusBadRequest, `{"error":"invalid_request","error_description":"Bad offset."}`, 1, "Bad offset"},
+		{"api error with 200", http.StatusOK, `{"error":"invalid_request","error_description":"Bad offset."}`, 1, "Bad offset"},
+		// A truncated response may be a network fault, so it's retried.
+		{"bad json", http.StatusOK, `{"results":`, 3, "failed to decode"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer server.Close()
+			client := newTestDAClient(server)
+
+			var result struct{}
+			err := getFrom(client, "/browse/newest", &result)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want one mentioning %q", err, test.want)
+			}
+			if requests != test.requests {
+				t.Errorf("sent %d requests, want %d", requests, test.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Compound DeviantArt queries are written in the /follow dialog as alternatives separated by "|", with "@name" words as an author allow-list,
+// e.g. "open commissions | ych @someartist @otherartist". A feed polls every alternative and keeps the posts from the listed authors, if any.
+// The feed's name is written without whitespace so it can be used in commands, e.g. "tag/open+commissions|ych@someartist@otherartist".
+
+// parseDAQuery reads a query from the /follow dialog into a new feed of the given type.
+func parseDAQuery(feedType string, text string) (dAFeed, error) {
+	var words, authors []string
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		if strings.HasPrefix(word, "@") {
+			author := strings.TrimPrefix(word, "@")
+			if author == "" || strings.ContainsAny(author, "|+") {
+				return dAFeed{}, fmt.Errorf("invalid author \"%s\"", word)
+			}
+			authors = append(authors, author)
+			continue
+		}
+		words = append(words, word)
+	}
+
+	var terms []string
+	for _, alternative := range strings.Split(strings.Join(words, " "), "|") {
+		term := strings.Join(strings.Fields(alternative), " ")
+		if term == "" {
+			return dAFeed{}, errors.New("every alternative must have a query")
+		}
+		if strings.Contains(term, "+") {
+			return dAFeed{}, errors.New("queries must not contain +")
+		}
+		if strings.Contains(term, " ") && feedType != "tag" && feedType != "popular" {
+			return dAFeed{}, fmt.Errorf("%s queries must not contain whitespace", feedType)
+		}
+		terms = append(terms, term)
+	}
+
+	names := make([]string, 0, len(terms))
+	for _, term := range terms {
+		names = append(names, strings.ReplaceAll(term, " ", "+"))
+	}
+	query := strings.Join(names, "|")
+	for _, author := range authors {
+		query += "@" + author
+	}
+
+	feed := dAFeed{FeedType: feedType, Query: query, Authors: authors}
+	// Simple queries keep their terms in Query alone, like feeds added before compound queries.
+	if query != terms[0] {
+		feed.Terms = terms
+	}
+	return feed, nil
+}
+
+// terms returns the queries the feed polls. Results from each are merged.
+func (f dAFeed) terms() []string {
+	if len(f.Terms) == 0 {
+		return []string{f.Query}
+	}
+	return f.Terms
+}
+
+// allowsAuthor reports whether the feed keeps posts by a user.
+func (f dAFeed) allowsAuthor(username string) bool {
+	if len(f.Authors) == 0 {
+		return true
+	}
+	for _, author := range f.Authors {
+		if strings.EqualFold(author, username) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseDAQuery(t *testing.T) {
+	tests := []struct {
+		feedType string
+		text     string
+		query    string // The feed's key query, or "" if the text is rejected.
+		terms    []string
+		authors  []string
+	}{
+		{"tag", "Adopt", "adopt", nil, nil},
+		{"tag", "open  commissions", "open+commissions", []string{"open commissions"}, nil},
+		{"tag", "ych | adopt", "ych|adopt", []string{"ych", "adopt"}, nil},
+		{"tag", "ych @SomeArtist | adopt @other", "ych|adopt@someartist@other", []string{"ych", "adopt"}, []string{"someartist", "other"}},
+		{"popular", "character design", "character+design", []string{"character design"}, nil},
+		{"user", "someartist", "someartist", nil, nil},
+		{"user", "some artist", "", nil, nil},
+		{"tag", "ych |", "", nil, nil},
+		{"tag", "@someartist", "", nil, nil},
+		{"tag", "ych @", "", nil, nil},
+		{"tag", "ych @a|b", "", nil, nil},
+		{"tag", "c++", "", nil, nil},
+	}
+	for _, test := range tests {
+		feed, err := parseDAQuery(test.feedType, test.text)
+		if test.query == "" {
+			if err == nil {
+				t.Errorf("parseDAQuery(%q, %q) = %+v, want an error", test.feedType, test.text, feed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDAQuery(%q, %q) failed: %v", test.feedType, test.text, err)
+			continue
+		}
+		if feed.Query != test.query || fmt.Sprint(feed.Terms) != fmt.Sprint(test.terms) || fmt.Sprint(feed.Authors) != fmt.Sprint(test.authors) {
+			t.Errorf("parseDAQuery(%q, %q) = %q %v %v, want %q %v %v", test.feedType, test.text, feed.Query, feed.Terms, feed.Authors, test.query, test.terms, test.authors)
+		}
+	}
+}
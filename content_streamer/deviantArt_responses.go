@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dAError is the error payload returned by the DeviantArt API, e.g. {"status": "error", "error": "invalid_request", "error_description": "..."}.
+type dAError struct {
+	Code        int    `json:"-"` // HTTP status code of the response.
+	Type        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e dAError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("DeviantArt API error %s (status %d)", e.Type, e.Code)
+	}
+	return fmt.Sprintf("DeviantArt API error %s (status %d): %s", e.Type, e.Code, e.Description)
+}
+
+// dATimestamp is a unix time, which the API sends as a string.
+type dATimestamp int64
+
+func (t *dATimestamp) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	if text == "" || text == "null" {
+		*t = 0
+		return nil
+	}
+	value, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", data)
+	}
+	*t = dATimestamp(value)
+	return nil
+}
+
+// dAResult is a deviation in a page of feed results. Only the fields the poller needs are decoded; the rest come from the metadata endpoint.
+type dAResult struct {
+	DeviationID   string      `json:"deviationid"`
+	URL           string      `json:"url"`
+	PublishedTime dATimestamp `json:"published_time"`
+	Author        dAUser      `json:"author"`
+	Preview       *dAImage    `json:"preview"`
+	Thumbs        []dAImage   `json:"thumbs"`
+	post          *deviation  // The whole post, for feeds whose posts the metadata endpoint doesn't know, such as statuses.
+}
+
+// dAPage is a page of results from the browse and gallery endpoints.
+type dAPage struct {
+	HasMore    bool       `json:"has_more"`
+	NextOffset *int       `json:"next_offset"` // Null on the last page.
+	Results    []dAResult `json:"results"`
+}
+
+// dAStatus is a status update, as returned by the statuses endpoint.
+type dAStatus struct {
+	StatusID  string `json:"statusid"`
+	Body      string `json:"body"` // HTML.
+	Timestamp string `json:"ts"`   // ISO 8601, e.g. "2020-05-19T12:00:00-0700".
+	URL       string `json:"url"`
+	Author    dAUser `json:"author"`
+	IsDeleted bool   `json:"is_deleted"`
+}
+
+// dAStatusTimeLayout is the layout of dAStatus.Timestamp.
+const dAStatusTimeLayout = "2006-01-02T15:04:05-0700"
+
+// dAStatusPage is a page of results from the statuses endpoint.
+type dAStatusPage struct {
+	HasMore    bool       `json:"has_more"`
+	NextOffset *int       `json:"next_offset"`
+	Results    []dAStatus `json:"results"`
+}
+
+// toPage converts a page of statuses to a page of feed results, each carrying the status as a post.
+func (p dAStatusPage) toPage() (dAPage, error) {
+	page := dAPage{HasMore: p.HasMore, NextOffset: p.NextOffset}
+	for _, status := range p.Results {
+		if status.IsDeleted {
+			continue
+		}
+		published, err := time.Parse(dAStatusTimeLayout, status.Timestamp)
+		if err != nil {
+			return dAPage{}, fmt.Errorf("invalid status timestamp \"%s\"", status.Timestamp)
+		}
+		page.Results = append(page.Results, dAResult{
+			DeviationID:   status.StatusID,
+			URL:           status.URL,
+			PublishedTime: dATimestamp(published.Unix()),
+			Author:        status.Author,
+			post: &deviation{
+				Deviationid:    status.StatusID,
+				URL:            status.URL,
+				Author:         status.Author,
+				Title:          fmt.Sprintf("Status update by %s", status.Author.Username),
+				Description:    status.Body,
+				AllowsComments: true,
+			},
+		})
+	}
+	return page, nil
+}
+
+// dAFolder is a gallery folder, as listed by the gallery folders endpoint.
+type dAFolder struct {
+	FolderID string `json:"folderid"`
+	Name     string `json:"name"`
+}
+
+// dAFolderPage is a page of results from the gallery folders endpoint.
+type dAFolderPage struct {
+	HasMore    bool       `json:"has_more"`
+	NextOffset *int       `json:"next_offset"`
+	Results    []dAFolder `json:"results"`
+}
+
+// dAMetadataResponse is the response of the deviation metadata endpoint.
+type dAMetadataResponse struct {
+	Metadata []deviation `json:"metadata"`
+}
+
+// dADeviationResponse is the subset of the single deviation endpoint that we use.
+type dADeviationResponse struct {
+	URL     string    `json:"url"`
+	Preview *dAImage  `json:"preview"`
+	Thumbs  []dAImage `json:"thumbs"`
+}
+
+// dATokenResponse is the response of the OAuth token endpoint.
+type dATokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"` // Seconds until the token expires.
+}
@@ -1,24 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"log"
-	"math"
-	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"go.mongodb.org/mongo-driver/mongo"
-
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
-	"go.mongodb.org/mongo-driver/bson"
 
 	"jaytaylor.com/html2text"
 )
@@ -26,42 +21,39 @@ import (
 // Current Version: 20200519
 
 // Configuration constants
-// Time to wait between polls of deviantArt
-const pollingDelay = 5 * time.Minute
-
 // When a new feed is added, get all posts in the last initialHistoryAmount seconds.
 const initialHistoryAmount = 50_000_000 // ~1 year, 7 months
 
-// Number of posts to be shown when adding a new feed.
-const newFeedNotificationLimit = 5
-
-// Maximum number of pages to download before ending. Primarily used to limit the initial feed.
-const maxPages = 10
-
 // Reability constants
 const urlEncoded = "application/x-www-form-urlencoded"
+const captionTagLimit = 15 // Tags shown in a notification's caption.
 const deviantartFeedCollection = "deviantartFeeds"
 
-// Global objects
-var dAFollows struct {
-	sync.RWMutex
-	feedChannel chan dAFeed // Circular channel of followed users
-}
-
-var dANewFeedSignal chan struct{}
-
 // TODO: Can I clean up the json/bson for these ones?
 // deviation implements the streamablePost interface, represeting a post drawn from deviantArt.
 type deviation struct {
-	Deviationid    string  `json:"deviationid" bson:"_id"`
-	URL            string  `json:"url" bson:"url"`
-	Author         dAUser  `json:"author" bson:"author"`
-	Title          string  `json:"title"`
-	Description    string  `json:"description"`
-	License        string  `json:"license"`
-	AllowsComments bool    `json:"allows_comments" bson:"allows_comments"`
-	Tags           []dATag `json:"tags"`
-	IsMature       bool    `json:"is_mature" bson:"is_mature"`
+	Deviationid    string             `json:"deviationid" bson:"_id"`
+	URL            string             `json:"url" bson:"url"`
+	Author         dAUser             `json:"author" bson:"author"`
+	Title          string             `json:"title"`
+	Description    string             `json:"description"`
+	License        string             `json:"license"`
+	AllowsComments bool               `json:"allows_comments" bson:"allows_comments"`
+	Tags           []dATag            `json:"tags"`
+	IsMature       bool               `json:"is_mature" bson:"is_mature"`
+	PublishedTime  int64              `json:"-" bson:"published_time,omitempty"`
+	Feed           string             `json:"-" bson:"feed,omitempty"`       // Feed the deviation was first downloaded from.
+	Revisions      []dARevision       `json:"-" bson:"revisions,omitempty"`  // Previous versions of the deviation, oldest first.
+	Commission     *commissionDetails `json:"-" bson:"commission,omitempty"` // Commission terms found in the title and description.
+	Preview        *dAImage           `json:"-" bson:"preview,omitempty"`    // Copied from the feed results, as the metadata endpoint doesn't return images.
+	Thumbs         []dAImage          `json:"-" bson:"thumbs,omitempty"`
+}
+
+// dAImage implements an image (as part of a deviation)
+type dAImage struct {
+	Src    string `json:"src" bson:"src"`
+	Width  int    `json:"width" bson:"width"`
+	Height int    `json:"height" bson:"height"`
 }
 
 // dATag implements a tag (as part of a deviation)
@@ -80,73 +72,117 @@ type dAUser struct {
 
 // dAFeed defines a stream to pull data from. It consists of metadata about the previous pull and the query that generates the feed.
 type dAFeed struct {
-	FeedType      string    `bson:"feed_type"`
-	Query         string    `bson:"query"`
-	LastQueryTime time.Time `bson:"last_query_time"`
-	LastPostTime  int64     `bson:"last_post_time"`
-	NewFeed       bool      `bson:"new_feed"`
+	FeedType        string    `bson:"feed_type"`
+	Query           string    `bson:"query"`
+	FolderID        string    `bson:"folder_id,omitempty"` // Gallery folder followed by a folder feed, whose query is "username/folder-name".
+	Terms           []string  `bson:"terms,omitempty"`     // Queries ORed by a compound feed. Empty if the feed polls Query alone.
+	Authors         []string  `bson:"authors,omitempty"`   // If set, only posts by these users are kept.
+	LastQueryTime   time.Time `bson:"last_query_time"`
+	LastPostTime    int64     `bson:"last_post_time"`
+	NewFeed         bool      `bson:"new_feed"`
+	Paused          bool      `bson:"paused"`
+	PostCount       int       `bson:"post_count"`
+	Hot             bool      `bson:"hot"`               // Always polled at the minimum delay.
+	RecentPostTimes []int64   `bson:"recent_post_times"` // Published times of the latest posts, oldest first, to learn how often the feed posts.
+	Positives       []int64   `bson:"positives"`         // Times posts from the feed were labelled as worth notifying, oldest first.
+}
+
+// parseDAFeedKey splits a feed name made by dAFeedKey back into the feed's type and query.
+func parseDAFeedKey(name string) (dAFeed, error) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		return dAFeed{}, errNotFound
+	}
+	return dAFeed{FeedType: parts[0], Query: parts[1]}, nil
+}
+
+// dAFeedTypes lists the types of DeviantArt feed, in the order they're offered by /follow, with the question asked for each query.
+var dAFeedTypes = []struct {
+	button   string
+	feedType string
+	question string
+}{
+	{"Tag", "tag", "And what would you like to search for? Separate alternatives with |, and add @name to only keep posts by those users, e.g. open commissions | ych @someartist"},
+	{"User", "user", "And what user would you like to follow?"},
+	{"Folder", "folder", "And whose gallery is the folder in?"},
+	{"Journals", "journal", "And whose journals would you like to follow?"},
+	{"Statuses", "status", "And whose status updates would you like to follow?"},
+	{"Popular", "popular", "And what would you like to follow the popular posts of? Separate alternatives with |, and add @name to only keep posts by those users."},
+	{"Topic", "topic", "And what topic would you like to follow? Use the name from its URL, e.g. digitalart."},
 }
 
-func (f dAFeed) getDAResults(offset int) map[string]interface{} {
+// ranked reports whether a feed is ordered by popularity rather than by time, so it can't stop at the first post it has already seen.
+func (f dAFeed) ranked() bool {
+	return f.FeedType == "popular" || f.FeedType == "topic"
+}
+
+// getDAResults downloads a page of results for one of the feed's terms.
+func (f dAFeed) getDAResults(ctx context.Context, term string, offset int) (dAPage, error) {
 	// Create parameter object to build url
 	params := url.Values{}
-	var apiURL string
+	var path string
 
 	switch f.FeedType {
 	case "user":
-		params.Add("username", f.Query)
-		apiURL = "https://www.deviantart.com/api/v1/oauth2/gallery/all"
+		params.Add("username", term)
+		path = "/gallery/all"
+	case "folder":
+		params.Add("username", strings.SplitN(term, "/", 2)[0])
+		params.Add("mode", "newest")
+		path = fmt.Sprintf("/gallery/%s", url.PathEscape(f.FolderID))
+	case "journal":
+		params.Add("username", term)
+		params.Add("featured", "false")
+		path = "/browse/user/journals"
+	case "status":
+		params.Add("username", term)
+		params.Add("offset", strconv.Itoa(offset))
+		params.Add("mature_content", "true")
+		// Statuses aren't deviations, so they come back whole rather than being looked up in the metadata endpoint.
+		var statuses dAStatusPage
+		err := dAClient.get(ctx, "/user/statuses/", params, &statuses)
+		if err != nil {
+			return dAPage{}, err
+		}
+		return statuses.toPage()
 	case "tag":
-		params.Add("q", f.Query)
-		apiURL = "https://www.deviantart.com/api/v1/oauth2/browse/newest"
+		params.Add("q", term)
+		path = "/browse/newest"
+	case "popular":
+		params.Add("q", term)
+		path = "/browse/popular"
+	case "topic":
+		params.Add("topic", term)
+		path = "/browse/topic"
 	default:
-		log.Panicf("Error: Invalid feed type \"%s\"\n", f.FeedType)
+		return dAPage{}, fmt.Errorf("invalid feed type \"%s\"", f.FeedType)
 	}
 	// Build parameters
 	params.Add("offset", strconv.Itoa(offset))
 	params.Add("mature_content", "true")
 
-	dAAccessToken.RLock()
-	params.Add("access_token", dAAccessToken.token)
-	dAAccessToken.RUnlock()
-
-	requestSting := params.Encode()
-
-	// Send request
-	resp, err := http.Get(fmt.Sprintf("%s?%s", apiURL, requestSting))
-	// Every time response fails, do exponential backoff and retry
-	attempts := 1
-	for err != nil && attempts < 10 {
-		// Calculate sleep time (2 ^ attempts)
-		backoff := int(math.Pow(float64(2), float64(attempts)))
-		log.Printf("Failed query to %v, retrying in %v seconds.", f.Query, backoff)
-		time.Sleep(time.Duration(backoff) * time.Second)
-		// Make response
-		resp, err = http.Get(fmt.Sprintf("%s?%s", apiURL, requestSting))
-		attempts++
-	}
-	// If after 10 attempts the error is still present, throw it.
-	if err != nil {
-		log.Panicln(err)
-	}
-
-	// Decode the results
-	var result map[string]interface{}
-
-	json.NewDecoder(resp.Body).Decode(&result)
-
-	return result
+	var page dAPage
+	err := dAClient.get(ctx, path, params, &page)
+	return page, err
 }
 
-// Global variable for access token storage.
-var dAAccessToken struct {
-	sync.RWMutex
-	token string
+// getDAFolders gets the gallery folders of a user.
+func getDAFolders(ctx context.Context, username string) ([]dAFolder, error) {
+	params := url.Values{}
+	params.Add("username", username)
+	params.Add("limit", "50")
+
+	var page dAFolderPage
+	err := dAClient.get(ctx, "/gallery/folders", params, &page)
+	return page.Results, err
 }
 
 // Convience wrapper to get a single deviation by id.
-func getDeviation(id string) (deviation, error) {
-	deviations := getDeviations([]string{id})
+func getDeviation(ctx context.Context, id string) (deviation, error) {
+	deviations, err := getDeviations(ctx, []string{id})
+	if err != nil {
+		return deviation{}, err
+	}
 	if len(deviations) == 0 {
 		return deviation{}, errors.New("deviation not found")
 	}
@@ -154,12 +190,21 @@ func getDeviation(id string) (deviation, error) {
 }
 
 // getDeviations pulls the metadata about a list of deviations from DeviantArt.
-func getDeviations(ids []string) []deviation {
+func getDeviations(ctx context.Context, ids []string) ([]deviation, error) {
 	// NOTE: This won't download URLs! Use getURL in addition for that.
 
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
 	// If there are too many ids to do in one go, run two queries and append the results.
 	if len(ids) > 50 {
-		return append(getDeviations(ids[:50]), getDeviations(ids[50:])...)
+		first, err := getDeviations(ctx, ids[:50])
+		if err != nil {
+			return nil, err
+		}
+		rest, err := getDeviations(ctx, ids[50:])
+		return append(first, rest...), err
 	}
 
 	// Build parameter list
@@ -168,303 +213,286 @@ func getDeviations(ids []string) []deviation {
 	for _, id := range ids {
 		params.Add("deviationids[]", id)
 	}
-	dAAccessToken.RLock()
-	params.Add("access_token", dAAccessToken.token)
-	dAAccessToken.RUnlock()
 
-	// Send query
-	resp, err := http.Get(fmt.Sprintf("https://www.deviantart.com/api/v1/oauth2/deviation/metadata?%s", params.Encode()))
-	if err != nil {
-		log.Panicln(err)
-	}
+	var results dAMetadataResponse
+	err := dAClient.get(ctx, "/deviation/metadata", params, &results)
 
-	// Decode the results. Anonomous struct to remove the top level metadata field.
-	var results struct {
-		Metadata []deviation `json:"metadata"`
-	}
-
-	json.NewDecoder(resp.Body).Decode(&results)
-
-	return results.Metadata
+	return results.Metadata, err
 
 }
 
-func (d *deviation) addURL() {
+func (d *deviation) addURL(ctx context.Context) error {
 	// Get URL by looking up deviation
-	// Build parameter list
-	params := url.Values{}
-	dAAccessToken.RLock()
-	params.Add("access_token", dAAccessToken.token)
-	dAAccessToken.RUnlock()
-
-	// Send query
-	resp, err := http.Get(fmt.Sprintf("https://www.deviantart.com/api/v1/oauth2/deviation/%s?%s", d.Deviationid, params.Encode()))
-	if err != nil {
-		log.Panicln(err)
-	}
-
-	// Decode the results. Anonomous struct to remove the top level metadata field.
-	var results struct {
-		URL string `json:"url"`
-	}
-
-	json.NewDecoder(resp.Body).Decode(&results)
+	var results dADeviationResponse
+	err := dAClient.get(ctx, fmt.Sprintf("/deviation/%s", url.PathEscape(d.Deviationid)), nil, &results)
 
 	d.URL = results.URL
+	d.Preview = results.Preview
+	d.Thumbs = results.Thumbs
+	return err
 }
 
-func (d deviation) decodeDBResult(dbResult *mongo.SingleResult) (result streamablePost, err error) {
+func (d deviation) decodeDBResult(decode func(interface{}) error) (result streamablePost, err error) {
 	post := deviation{}
-	err = dbResult.Decode(&post)
+	err = decode(&post)
 	result = post
 	return
 }
 
-// dADownloadWorker defines a goroutine which pulls from the follow channel, downloads from the feed and puts results in the downloadQueue
-func dADownloadWorker(writeQueue chan<- postMessage) {
+// dADownloadWorker defines a goroutine which takes feeds from the scheduler as they fall due, downloads from them and puts results in the downloadQueue.
+// It returns once ctx is cancelled. A poll that's cancelled part way through doesn't advance the feed, so it is repeated on restart.
+func dADownloadWorker(ctx context.Context, writeQueue chan<- postMessage) error {
 
-	for {
-		// Get the next search and wait until the next polling opportunity
-		dAFollows.RLock()
-		feed := <-dAFollows.feedChannel
-		dAFollows.RUnlock()
-
-		select {
-		// Wait for polling time from last query
-		case <-time.After(pollingDelay - time.Since(feed.LastQueryTime)):
-		// If a new feed is added, put the current search back
-		// and get the new one out.
-		case <-dANewFeedSignal:
-			dAFollows.RLock()
-			dAFollows.feedChannel <- feed
-			feed = <-dAFollows.feedChannel
-			dAFollows.RUnlock()
+	var feed dAFeed
+	holdingFeed := false
+	// If the worker stops (or panics) while holding a feed, hand it back so it isn't lost.
+	defer func() {
+		if holdingFeed {
+			dASchedule.done(feed)
 		}
+	}()
 
-		if debug {
-			log.Printf("Polling deviantart feed \"%s\"\n", feed.Query)
+	for {
+		var ok bool
+		feed, ok = dASchedule.next(ctx)
+		if !ok {
+			return nil
 		}
+		holdingFeed = true
 
-		// Store the new ids to analyse in one go.
-		newIDs := make([]string, 0)
-		postURLs := make(map[string]string)
-
-		newLastPostTime := feed.LastPostTime
-		offset := 0
-	dAResultParseLoop:
-		for page := 0; page < maxPages; page++ {
-			// Pull from feed and extract results.
-			query := feed.getDAResults(offset)
-			// TODO: Remove this type switch after finding the error (DEBUG)
-			var results []interface{}
-			switch r := query["results"].(type) {
-			case []interface{}:
-				results = r
-			case nil:
-				log.Println("Got nil results!")
-				log.Println("Query: ", query)
-				continue
-			}
-			// results := query["results"].([]interface{})
-
-			// If the result list is empty, skip.
-			if debug && len(results) == 0 {
-				log.Printf("Skipping query %s (empty result list).\n", feed.Query)
-				break dAResultParseLoop
-			}
+		updatedFeed, err := pollDAFeed(ctx, feed, writeQueue)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errNotFound) {
+			// The feed was unfollowed during the poll, and the scheduler drops it when it's handed back.
+		} else if err != nil {
+			// Report the failure. The feed is tried again after its usual interval.
+			reportError(fmt.Sprintf("DeviantArt %s feed \"%s\"", feed.FeedType, feed.Query), err)
+		} else {
+			feed = updatedFeed
+		}
 
-			for _, result := range results {
-				result := result.(map[string]interface{})
+		holdingFeed = false
+		dASchedule.done(feed)
+	}
+}
 
-				// Parse the published time return value
-				publishedTime, err := strconv.ParseInt(result["published_time"].(string), 10, 64)
-				if err != nil {
-					log.Panicln(err)
-				}
-				// If the result is older than the last parse time, end the query.
-				if publishedTime <= feed.LastPostTime {
-					break dAResultParseLoop
-				}
+// newResults downloads the results for one of the feed's terms that are newer than its last poll, newest first.
+func (f dAFeed) newResults(ctx context.Context, term string) ([]dAResult, error) {
+	var results []dAResult
 
-				// Set newQueryTime to the newest post time.
-				if publishedTime > newLastPostTime {
-					newLastPostTime = publishedTime
-				}
+	// Ranked feeds have no point past which every post has been seen, so only their first page is read.
+	maxPages := conf.Polling.MaxPages
+	if f.ranked() {
+		maxPages = 1
+	}
 
-				deviationid := result["deviationid"].(string)
-				// Add the new post to the newID string
-				newIDs = append(newIDs, deviationid)
-				postURLs[deviationid] = result["url"].(string)
-			}
-			// If we're out of posts, quit the loop.
-			if !query["has_more"].(bool) {
-				break dAResultParseLoop
-			}
-			// If we haven't hit old posts yet, move to the next page.
-			offset = int(query["next_offset"].(float64))
+	offset := 0
+	for page := 0; page < maxPages; page++ {
+		// Pull from feed and extract results.
+		response, err := f.getDAResults(ctx, term, offset)
+		if err != nil {
+			return nil, err
 		}
 
-		// Get the deviation objects.
-		newDeviations := getDeviations(newIDs)
-
-		// Put them into the output queue.
-		for i, deviation := range newDeviations {
-
-			var setNotify *bool
-
-			// If the feed is new, force notifications for the most recent few posts, and suppress all others.
-			if feed.NewFeed {
-				setNotify = BoolPointer(i < newFeedNotificationLimit)
-			} else {
-				setNotify = nil
+		for _, result := range response.Results {
+			if result.DeviationID == "" || result.PublishedTime == 0 {
+				return nil, fmt.Errorf("result at offset %d is missing its id or published time", offset)
 			}
 
-			// Set URL from the list we store before sending them off.
-			deviation.URL = postURLs[deviation.Deviationid]
-			writeQueue <- postMessage{
-				post:      deviation,
-				setNotify: setNotify,
-				skipWrite: false,
+			if f.ranked() {
+				// Skip posts already downloaded on an earlier poll.
+				if _, err := db.getPost("deviantart", result.DeviationID); err == nil {
+					continue
+				}
+			} else if int64(result.PublishedTime) <= f.LastPostTime {
+				// If the result is older than the last parse time, end the query.
+				return results, nil
 			}
+			results = append(results, result)
 		}
-
-		// Set the lastQueryTime and lastPostTime to the current values
-		feed.LastQueryTime = time.Now()
-		feed.LastPostTime = newLastPostTime
-
-		// Set the NewFeed tag to false.
-		feed.NewFeed = false
-
-		// Update the feed object in the database.
-		filter := bson.M{"feed_type": feed.FeedType, "query": feed.Query}
-		update := bson.M{"$set": bson.M{"last_query_time": feed.LastQueryTime, "last_post_time": feed.LastPostTime, "new_feed": feed.NewFeed}}
-		_, err := database.Collection(deviantartFeedCollection).UpdateOne(context.TODO(), filter, update)
-		if err != nil {
-			log.Panicln(err)
+		// If we're out of posts, quit the loop.
+		if !response.HasMore || response.NextOffset == nil {
+			break
 		}
-
-		// Put the current seach back into the queue.
-		dAFollows.RLock()
-		dAFollows.feedChannel <- feed
-		dAFollows.RUnlock()
+		// If we haven't hit old posts yet, move to the next page.
+		offset = *response.NextOffset
 	}
+	return results, nil
 }
 
-// getDAAcessToken refreshes the access token stored in dAAccessToken
-func getDAAccessToken() {
+// pollDAFeed downloads the new posts in a feed, puts them in the write queue, and saves the feed's new position to the database.
+func pollDAFeed(ctx context.Context, feed dAFeed, writeQueue chan<- postMessage) (dAFeed, error) {
 
-	dAKeys, ok := keys["deviantArt"].(map[interface{}]interface{})
-	if !ok {
-		log.Printf("Error with DeviantArt keys. \n Message: \n")
-		dAKeys = keys["deviantArt"].(map[interface{}]interface{})
+	if debug {
+		log.Printf("Polling deviantart feed \"%s\"\n", feed.Query)
 	}
 
-	// Build url encoding of request.
-	params := url.Values{}
-	params.Add("grant_type", "client_credentials")
-	dA_client_id, ok := dAKeys["client_id"].(string)
-	if !ok {
-		dA_client_id_int, ok := dAKeys["client_id"].(int)
-		if !ok {
-			log.Panicln("DeviantArt client_id is missing or malformed.")
+	// Store the new ids to analyse in one go.
+	newIDs := make([]string, 0)
+	postURLs := make(map[string]string)
+	images := make(map[string]dAResult)
+	publishedTimes := make(map[string]int64)
+	wholePosts := make(map[string]deviation)
+
+	// Merge the results of each of the feed's terms, keeping posts found by several once.
+	var results []dAResult
+	for _, term := range feed.terms() {
+		termResults, err := feed.newResults(ctx, term)
+		if err != nil {
+			return feed, err
 		}
-		dA_client_id = fmt.Sprint(dA_client_id_int)
+		results = append(results, termResults...)
 	}
-	dA_client_secret, ok := dAKeys["client_secret"].(string)
-	if !ok {
-		log.Panicln("DeviantArt client_secret is missing or malformed.")
+	if len(feed.terms()) > 1 {
+		// Newest first, like a single term's results, so a new feed notifies its most recent posts.
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].PublishedTime > results[j].PublishedTime
+		})
 	}
 
-	params.Add("client_id", dA_client_id)
-	params.Add("client_secret", dA_client_secret)
+	newLastPostTime := feed.LastPostTime
+	for _, result := range results {
+		publishedTime := int64(result.PublishedTime)
 
-	requestSting := params.Encode()
+		// Set newQueryTime to the newest post time.
+		if publishedTime > newLastPostTime {
+			newLastPostTime = publishedTime
+		}
+
+		if _, ok := publishedTimes[result.DeviationID]; ok || !feed.allowsAuthor(result.Author.Username) {
+			continue
+		}
 
-	// Send request
-	resp, err := http.Post("https://www.deviantart.com/oauth2/token",
-		urlEncoded,
-		bytes.NewBufferString(requestSting))
+		// Add the new post to the newID string
+		newIDs = append(newIDs, result.DeviationID)
+		postURLs[result.DeviationID] = result.URL
+		images[result.DeviationID] = result
+		publishedTimes[result.DeviationID] = publishedTime
+		if result.post != nil {
+			wholePosts[result.DeviationID] = *result.post
+		}
+	}
 
+	// Get the deviation objects, keeping the feed's order.
+	lookupIDs := make([]string, 0, len(newIDs))
+	for _, id := range newIDs {
+		if _, ok := wholePosts[id]; !ok {
+			lookupIDs = append(lookupIDs, id)
+		}
+	}
+	metadata, err := getDeviations(ctx, lookupIDs)
 	if err != nil {
-		log.Panicln(err)
+		return feed, err
+	}
+	for _, d := range metadata {
+		wholePosts[d.Deviationid] = d
+	}
+	newDeviations := make([]deviation, 0, len(newIDs))
+	for _, id := range newIDs {
+		if d, ok := wholePosts[id]; ok {
+			newDeviations = append(newDeviations, d)
+		}
 	}
 
-	// Decode the results
-	var result map[string]interface{}
+	// Put them into the output queue.
+	for i, deviation := range newDeviations {
 
-	json.NewDecoder(resp.Body).Decode(&result)
+		var setNotify *bool
 
-	// If the response doesn't contain a valid token, throw an error.
-	token, ok := result["access_token"]
-	if !ok {
-		log.Fatalf("Error: DeviantArt token refresh failed with error %s\n", result["error"])
+		// If the feed is new, force notifications for the most recent few posts, and suppress all others.
+		if feed.NewFeed {
+			setNotify = BoolPointer(i < conf.Polling.NewFeedNotificationLimit)
+		} else {
+			setNotify = nil
+		}
+
+		// Set the fields from the list we store before sending them off.
+		deviation.URL = postURLs[deviation.Deviationid]
+		deviation.Preview = images[deviation.Deviationid].Preview
+		deviation.Thumbs = images[deviation.Deviationid].Thumbs
+		deviation.PublishedTime = publishedTimes[deviation.Deviationid]
+		deviation.Feed = dAFeedKey(feed)
+		deviation.Commission = extractCommission(strings.Join(deviation.filterFields().Text, "\n"), time.Unix(deviation.PublishedTime, 0))
+		// Popular posts aren't published on the feed's schedule, so they don't teach its cadence.
+		if !feed.ranked() {
+			feed.RecentPostTimes = append(feed.RecentPostTimes, deviation.PublishedTime)
+		}
+		writeQueue <- postMessage{
+			post:      deviation,
+			setNotify: setNotify,
+			skipWrite: false,
+			feed:      dAFeedKey(feed),
+		}
 	}
 
-	// Set the token globally.
-	dAAccessToken.Lock()
-	dAAccessToken.token = token.(string)
-	dAAccessToken.Unlock()
+	// Set the lastQueryTime and lastPostTime to the current values
+	feed.LastQueryTime = time.Now()
+	feed.LastPostTime = newLastPostTime
 
-}
+	// Set the NewFeed tag to false.
+	feed.NewFeed = false
+	feed.PostCount += len(newDeviations)
+	feed.RecentPostTimes = trimHistory(feed.RecentPostTimes)
 
-func dASupervisor() {
-	// TODO: Implement
+	// Update the feed object in the database.
+	return feed, db.updateDAFeed(feed)
 }
 
-// createDownloadStream spawns goroutines to follow the deviantart streams.
-func (deviation) createDownloadStream(writeQueue chan<- postMessage, workers int) {
+// createDownloadStream spawns goroutines to follow the deviantart streams, and returns once they've stopped.
+func (deviation) createDownloadStream(ctx context.Context, writeQueue chan<- postMessage, workers int) error {
 
-	// Read follow files from database and add to queue.
-	var tagList []dAFeed
-	cursor, err := database.Collection(deviantartFeedCollection).Find(context.TODO(), bson.D{})
-	if err != nil {
-		log.Fatalln(err)
+	if conf.DeviantArt.ClientID == "" {
+		log.Println("No DeviantArt client id found. DeviantArt streaming disabled.")
+		return nil
 	}
 
-	// Decode all results
-	err = cursor.All(context.TODO(), &tagList)
+	// Read follow files from database and add to queue.
+	tagList, err := db.getDAFeeds()
 	if err != nil {
-		log.Fatalln(err)
+		return fmt.Errorf("failed to read DeviantArt feeds: %w", err)
 	}
 
-	dAFollows.Lock()
-	// Create the follow queue and add all tags to it.
-	dAFollows.feedChannel = make(chan dAFeed, len(tagList))
+	// Schedule each feed for when it's next due. Feeds that have never been polled, or are overdue, are due straight away.
 	for _, tag := range tagList {
-		dAFollows.feedChannel <- tag
+		dASchedule.add(tag, tag.LastQueryTime.Add(withJitter(dAPollInterval(tag))))
 	}
-	dAFollows.Unlock()
-
-	dANewFeedSignal = make(chan struct{})
-
-	// If there are no feeds, we don't want to start polling.
-	// Print a warning. Wait for new feeds to be added before continuing.
 	if len(tagList) == 0 {
 		log.Println("No DeviantArt feeds found. Waiting for new feeds via telegram.")
-		<-dANewFeedSignal
 	}
 
-	// Request an access token.
-	getDAAccessToken()
-
-	// Every 59 minutes, get a new access token. Token expires every 60 minutes.
+	// Spawn the token refresher, the edit re-checker if enabled, and a worker for each in the range of workers, each under its own supervisor, and wait for them to finish.
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		for {
-			time.Sleep(59 * time.Minute)
-			getDAAccessToken()
-		}
+		defer wg.Done()
+		supervise(ctx, "DeviantArt token refresher", dAClient.tokens.run)
 	}()
-
-	// Spawn a supervisor task
-	go dASupervisor()
-
-	// Spawn a worker for each in the range of workers.
+	if conf.Polling.RecheckInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			supervise(ctx, "DeviantArt edit re-checker", func(ctx context.Context) error {
+				return dARechecker(ctx, writeQueue)
+			})
+		}()
+	}
 	for i := 0; i < workers; i++ {
-		go dADownloadWorker(writeQueue)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			supervise(ctx, fmt.Sprintf("DeviantArt worker %d", i), func(ctx context.Context) error {
+				return dADownloadWorker(ctx, writeQueue)
+			})
+		}(i)
 	}
 
 	log.Printf("Started %d DeviantArt workers.\n", workers)
 
+	wg.Wait()
+	log.Println("Stopped DeviantArt workers.")
+	return nil
 }
 
 func (d deviation) formatLink() string {
@@ -474,13 +502,65 @@ func (d deviation) formatLink() string {
 func (d deviation) formatPost() string {
 	description, err := html2text.FromString(d.Description)
 	if err != nil {
-		log.Panicln(err)
+		// Fall back to the raw HTML rather than losing the description.
+		log.Printf("Failed to convert description of %s to text.\nError: %s\n", d.Deviationid, err)
+		description = d.Description
 	}
 	return fmt.Sprintf("%s\n"+
 		"--------------------------------------------------------------------------------------\n"+
 		"%s", d.Title, description)
 }
 
+func (d deviation) formatCaption() string {
+	caption := fmt.Sprintf("<b><a href=\"%s\">%s</a></b>", html.EscapeString(d.URL), html.EscapeString(d.Title))
+	if d.Author.Username != "" {
+		caption += fmt.Sprintf(" by <a href=\"https://www.deviantart.com/%s\">%s</a>", url.PathEscape(d.Author.Username), html.EscapeString(d.Author.Username))
+	}
+	if len(d.Tags) > 0 {
+		tags := make([]string, 0, len(d.Tags))
+		for i, tag := range d.Tags {
+			if i == captionTagLimit {
+				tags = append(tags, "…")
+				break
+			}
+			tags = append(tags, "#"+html.EscapeString(tag.TagName))
+		}
+		caption += "\n" + strings.Join(tags, " ")
+	}
+	return caption
+}
+
+// previewImage returns the preview, or the largest thumbnail if there's no preview.
+func (d deviation) previewImage() string {
+	if d.Preview != nil && d.Preview.Src != "" {
+		return d.Preview.Src
+	}
+	best := dAImage{}
+	for _, thumb := range d.Thumbs {
+		if thumb.Width*thumb.Height > best.Width*best.Height {
+			best = thumb
+		}
+	}
+	return best.Src
+}
+
+func (d deviation) filterFields() postFields {
+	description, err := html2text.FromString(d.Description)
+	if err != nil {
+		description = d.Description
+	}
+	tags := make([]string, 0, len(d.Tags))
+	for _, tag := range d.Tags {
+		tags = append(tags, tag.TagName)
+	}
+	return postFields{
+		Author: d.Author.Username,
+		Tags:   tags,
+		Text:   []string{d.Title, description},
+		Mature: d.IsMature,
+	}
+}
+
 func (deviation) siteName() string {
 	return "deviantart"
 }
@@ -493,115 +573,187 @@ func (d deviation) getID() string {
 	return d.Deviationid
 }
 
-func (deviation) addFollowHandler() func(tgbotapi.Update) (bool, interface{}) {
+func (deviation) addFollowHandler(chatID int64) stepHandler {
 	msg := tgbotapi.NewMessage(chatID, "What type of follow would you like to add?")
-	replyKeyboard := tgbotapi.NewReplyKeyboard(tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("Tag")),
-		tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton("User")))
+	rows := make([][]tgbotapi.KeyboardButton, 0, len(dAFeedTypes))
+	for _, t := range dAFeedTypes {
+		rows = append(rows, tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton(t.button)))
+	}
+	replyKeyboard := tgbotapi.NewReplyKeyboard(rows...)
 	replyKeyboard.OneTimeKeyboard = true
 	replyKeyboard.ResizeKeyboard = true
 	msg.ReplyMarkup = replyKeyboard
 
-	telegramBot.Send(msg)
+	sendMessage(msg)
 	return handleFollowType
 }
 
-func handleFollowType(update tgbotapi.Update) (waitForResponse bool, responseHandler interface{}) {
-	var msg tgbotapi.MessageConfig
-	switch update.Message.Text {
-	case "Tag":
-		msg = tgbotapi.NewMessage(update.Message.Chat.ID, "And what tag would you like to follow?")
-		waitForResponse = true
-		responseHandler = func(update tgbotapi.Update) (bool, interface{}) {
-			return handleAddFeed("tag", update)
+func handleFollowType(update tgbotapi.Update) (next stepHandler) {
+	for _, t := range dAFeedTypes {
+		if update.Message.Text != t.button {
+			continue
 		}
-	case "User":
-		msg = tgbotapi.NewMessage(update.Message.Chat.ID, "And what user would you like to follow?")
-		waitForResponse = true
-		responseHandler = func(update tgbotapi.Update) (bool, interface{}) {
-			return handleAddFeed("user", update)
+		feedType := t.feedType
+		sendMessage(tgbotapi.NewMessage(update.Message.Chat.ID, t.question))
+		if feedType == "folder" {
+			return handleFolderUser
+		}
+		return func(update tgbotapi.Update) stepHandler {
+			return handleAddFeed(feedType, update)
 		}
-	default:
-		msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I don't recognise that follow type. Please start again.")
-		waitForResponse = false
-		responseHandler = interface{}(nil)
 	}
-	telegramBot.Send(msg)
-	return
+	sendMessage(tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I don't recognise that follow type. Please start again."))
+	return nil
 }
 
-func handleAddFeed(feedType string, update tgbotapi.Update) (bool, interface{}) {
-
+// readFeedQuery reads a one word query from a reply in the /follow dialog, lowercased. It tells the user and returns false if the reply isn't one word.
+func readFeedQuery(update tgbotapi.Update) (string, bool) {
 	// Check string contains whitespace, in which case break.
 	if len(strings.Fields(update.Message.Text)) != 1 {
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Invalid query - query must not contain whitespace.")
-		telegramBot.Send(msg)
-		return false, nil
+		sendMessage(msg)
+		return "", false
 	}
+	return strings.ToLower(update.Message.Text), true
+}
 
-	query := strings.ToLower(update.Message.Text)
-
-	// Create a new feed from the parameters and insert it.
-	newFeed := dAFeed{
-		FeedType:      feedType,
-		Query:         query,
-		LastPostTime:  time.Now().Unix() - initialHistoryAmount,
-		LastQueryTime: time.Time{},
-		NewFeed:       true,
-	}
-	_, err := database.Collection(deviantartFeedCollection).InsertOne(context.TODO(), newFeed)
+func handleAddFeed(feedType string, update tgbotapi.Update) stepHandler {
+	feed, err := parseDAQuery(feedType, update.Message.Text)
 	if err != nil {
-		log.Panicln(err)
+		sendMessage(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Invalid query - %s.", err)))
+		return nil
 	}
+	addDAFeed(update.Message.Chat.ID, feed)
+	return nil
+}
 
-	// Send message to confirm.
-	msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Added %s feed with query \"%s\"!", feedType, update.Message.Text))
-	_, err = telegramBot.Send(msg)
+// handleFolderUser lists the gallery folders of the user named in the reply, and asks which one to follow.
+func handleFolderUser(update tgbotapi.Update) stepHandler {
+	chatID := update.Message.Chat.ID
+	username, ok := readFeedQuery(update)
+	if !ok {
+		return nil
+	}
+
+	folders, err := getDAFolders(context.TODO(), username)
 	if err != nil {
-		log.Panicln(err)
+		log.Printf("Failed to get the gallery folders of %s.\nError: %s\n", username, err)
+		sendMessage(tgbotapi.NewMessage(chatID, "Sorry, I couldn't get that user's gallery folders. Please check the name and try again."))
+		return nil
+	}
+	if len(folders) == 0 {
+		sendMessage(tgbotapi.NewMessage(chatID, fmt.Sprintf("%s has no gallery folders.", username)))
+		return nil
 	}
 
-	if debug {
-		log.Println("Waiting for dAFollows to unlock...")
+	msg := tgbotapi.NewMessage(chatID, "Which folder would you like to follow?")
+	rows := make([][]tgbotapi.KeyboardButton, 0, len(folders))
+	for _, folder := range folders {
+		rows = append(rows, tgbotapi.NewKeyboardButtonRow(tgbotapi.NewKeyboardButton(folder.Name)))
 	}
+	replyKeyboard := tgbotapi.NewReplyKeyboard(rows...)
+	replyKeyboard.OneTimeKeyboard = true
+	replyKeyboard.ResizeKeyboard = true
+	msg.ReplyMarkup = replyKeyboard
+	sendMessage(msg)
 
-	// Expand the current buffer and add the new feed,
-	// Note - we do this after sending the message this can take a while (has to aquire global lock on the feed channel).
-	dAFollows.Lock()
-	// Expand buffer by one
-	newChan := make(chan dAFeed, cap(dAFollows.feedChannel)+1)
-	newChan <- newFeed
-	// Put each of the previous feeds into the new channel.
-	currentFeeds := len(dAFollows.feedChannel)
-	for i := 0; i < currentFeeds; i++ {
-		newChan <- <-dAFollows.feedChannel
+	return func(update tgbotapi.Update) stepHandler {
+		for _, folder := range folders {
+			if update.Message.Text != folder.Name {
+				continue
+			}
+			// Feed names can't contain whitespace, so the folder is named like the slug in its URL.
+			slug := strings.Join(strings.Fields(strings.ToLower(folder.Name)), "-")
+			addDAFeed(chatID, dAFeed{FeedType: "folder", Query: username + "/" + slug, FolderID: folder.FolderID})
+			return nil
+		}
+		sendMessage(tgbotapi.NewMessage(chatID, "Sorry, I don't recognise that folder. Please start again."))
+		return nil
 	}
-	dAFollows.feedChannel = newChan
-	dAFollows.Unlock()
+}
 
-	if debug {
-		log.Println("Finished adding to dAFollows.")
+// addDAFeed saves a new feed from the /follow dialog, schedules it, and confirms it in the chat.
+func addDAFeed(chatID int64, newFeed dAFeed) {
+	newFeed.LastPostTime = time.Now().Unix() - initialHistoryAmount
+	newFeed.LastQueryTime = time.Time{}
+	newFeed.NewFeed = true
+
+	err := db.insertDAFeed(newFeed)
+	if err != nil {
+		log.Printf("Failed to add %s feed \"%s\".\nError: %s\n", newFeed.FeedType, newFeed.Query, err)
+		sendMessage(tgbotapi.NewMessage(chatID, "Sorry, I couldn't save that feed. Please try again."))
+		return
 	}
+	forgetRemovedFeed("deviantart", dAFeedKey(newFeed))
 
-	select {
-	case dANewFeedSignal <- struct{}{}:
-		if debug {
-			log.Println("Signaled new DeviantArt feed.")
-		}
-	default:
+	// Poll the new feed straight away.
+	dASchedule.add(newFeed, time.Now())
+
+	// Send message to confirm.
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Added %s feed with query \"%s\"!", newFeed.FeedType, newFeed.Query))
+	sendMessage(msg)
+}
+
+func (deviation) getFeeds() ([]feedSummary, error) {
+	feeds, err := db.getDAFeeds()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]feedSummary, 0, len(feeds))
+	for _, feed := range feeds {
+		summaries = append(summaries, feedSummary{
+			Name:          dAFeedKey(feed),
+			LastQueryTime: feed.LastQueryTime,
+			PostCount:     feed.PostCount,
+			Paused:        feed.Paused,
+			Hot:           feed.Hot,
+			Interval:      dAPollInterval(feed),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries, nil
+}
+
+func (deviation) setFeedPaused(name string, paused bool) error {
+	feed, err := parseDAFeedKey(name)
+	if err != nil {
+		return err
 	}
+	err = db.setDAFeedPaused(feed, paused)
+	if err != nil {
+		return err
+	}
+	dASchedule.setPaused(name, paused)
+	return nil
+}
 
-	return false, nil
+func (deviation) removeFeed(name string) error {
+	feed, err := parseDAFeedKey(name)
+	if err != nil {
+		return err
+	}
+	err = db.deleteDAFeed(feed)
+	if err != nil {
+		return err
+	}
+	dASchedule.remove(name)
+	return nil
 }
 
 func (deviation) downloadPost(id string) (postMessage, error) {
 
-	post, err := getDeviation(id)
+	post, err := getDeviation(context.TODO(), id)
 
 	if err != nil {
 		return postMessage{}, err
 	}
 
-	post.addURL()
+	err = post.addURL(context.TODO())
+	if err != nil {
+		return postMessage{}, err
+	}
 
 	// log.Printf("URL: %s", post.URL)
 	return postMessage{
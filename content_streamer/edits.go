@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"jaytaylor.com/html2text"
+)
+
+// Number of previous versions kept on an edited post.
+const revisionHistory = 10
+
+// dARevision is a previous version of an edited deviation.
+type dARevision struct {
+	Time        time.Time `bson:"time"` // When the edit was found.
+	Title       string    `bson:"title"`
+	Description string    `bson:"description"`
+	Tags        []dATag   `bson:"tags"`
+}
+
+// normaliseText reduces a title or HTML description to its lowercased words, so changes to formatting, spacing and case are ignored.
+func normaliseText(text string) string {
+	plain, err := html2text.FromString(text)
+	if err != nil {
+		plain = text
+	}
+	return strings.ToLower(strings.Join(strings.Fields(plain), " "))
+}
+
+// normaliseTags returns a deviation's tag names lowercased and sorted, so reordered tags are ignored.
+func normaliseTags(tags []dATag) string {
+	names := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		names = append(names, strings.ToLower(tag.TagName))
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// dAChanges lists the parts of a deviation that have meaningfully changed between its stored and current versions, e.g. "title and tags".
+// It returns an empty string if nothing has.
+func dAChanges(stored deviation, current deviation) string {
+	var changes []string
+	if normaliseText(stored.Title) != normaliseText(current.Title) {
+		changes = append(changes, "title")
+	}
+	if normaliseText(stored.Description) != normaliseText(current.Description) {
+		changes = append(changes, "description")
+	}
+	if normaliseTags(stored.Tags) != normaliseTags(current.Tags) {
+		changes = append(changes, "tags")
+	}
+	if len(changes) <= 1 {
+		return strings.Join(changes, "")
+	}
+	return strings.Join(changes[:len(changes)-1], ", ") + " and " + changes[len(changes)-1]
+}
+
+// dARechecker re-fetches recent DeviantArt posts every polling.recheck_interval, until ctx is cancelled.
+// An edited post has its new version saved, and is queued to be classified and notified again.
+func dARechecker(ctx context.Context, writeQueue chan<- postMessage) error {
+	ticker := time.NewTicker(conf.Polling.RecheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		err := recheckDeviations(ctx, writeQueue)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			reportError("DeviantArt edit re-check", err)
+		}
+	}
+}
+
+// recheckDeviations compares the posts published within polling.recheck_window with their current versions on DeviantArt.
+func recheckDeviations(ctx context.Context, writeQueue chan<- postMessage) error {
+	stored, err := db.getRecentDeviations(time.Now().Add(-conf.Polling.RecheckWindow).Unix())
+	if err != nil {
+		return fmt.Errorf("failed to read recent posts: %w", err)
+	}
+
+	// Statuses aren't deviations, so the metadata endpoint can't look them up.
+	ids := make([]string, 0, len(stored))
+	for _, d := range stored {
+		if !strings.HasPrefix(d.Feed, "status/") {
+			ids = append(ids, d.Deviationid)
+		}
+	}
+	current, err := getDeviations(ctx, ids)
+	if err != nil {
+		return err
+	}
+	currentByID := make(map[string]deviation, len(current))
+	for _, d := range current {
+		currentByID[d.Deviationid] = d
+	}
+
+	edited := 0
+	for _, d := range stored {
+		latest, ok := currentByID[d.Deviationid]
+		if !ok {
+			continue
+		}
+		changes := dAChanges(d, latest)
+		if changes == "" {
+			continue
+		}
+
+		previous := dARevision{Time: time.Now(), Title: d.Title, Description: d.Description, Tags: d.Tags}
+		d.Title = latest.Title
+		d.Description = latest.Description
+		d.Tags = latest.Tags
+		d.Commission = extractCommission(strings.Join(d.filterFields().Text, "\n"), time.Unix(d.PublishedTime, 0))
+		err = db.addDeviationRevision(d, previous)
+		if err != nil {
+			return fmt.Errorf("failed to save edit of post %s: %w", d.Deviationid, err)
+		}
+		d.Revisions = append(d.Revisions, previous)
+
+		select {
+		case writeQueue <- postMessage{post: d, skipWrite: true, feed: d.Feed, edit: changes}:
+		case <-ctx.Done():
+			return nil
+		}
+		edited++
+	}
+
+	if debug || edited > 0 {
+		log.Printf("Re-checked %d DeviantArt posts, %d edited.\n", len(ids), edited)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// feedSummary describes a followed feed, for listing in the telegram chat.
+type feedSummary struct {
+	Name          string // As set in each postMessage.
+	LastQueryTime time.Time
+	PostCount     int // Posts downloaded from the feed since it was followed.
+	Paused        bool
+	Hot           bool          // Always polled at the minimum delay.
+	Interval      time.Duration // Time between polls, if it's set per feed.
+}
+
+// feedID identifies a feed across every site.
+func feedID(site string, name string) string {
+	return site + "/" + name
+}
+
+// Feeds paused or unfollowed from the telegram chat.
+// The twitter pollers check these before each poll, so changes take effect without a restart. The DeviantArt scheduler is told directly.
+var feedControl struct {
+	sync.RWMutex
+	paused  map[string]bool // By feedID.
+	removed map[string]bool // Unfollowed feeds that a poller may still be holding, by feedID.
+}
+
+// loadFeedControl reads which feeds are paused from the store.
+func loadFeedControl() error {
+	paused := make(map[string]bool)
+	for _, site := range siteTypes {
+		feeds, err := site.getFeeds()
+		if err != nil {
+			return fmt.Errorf("failed to read %s feeds: %w", site.prettySiteName(), err)
+		}
+		for _, feed := range feeds {
+			if feed.Paused {
+				paused[feedID(site.siteName(), feed.Name)] = true
+			}
+		}
+	}
+
+	feedControl.Lock()
+	defer feedControl.Unlock()
+	feedControl.paused = paused
+	feedControl.removed = make(map[string]bool)
+	return nil
+}
+
+// feedPaused reports whether a feed is paused.
+func feedPaused(site string, name string) bool {
+	feedControl.RLock()
+	defer feedControl.RUnlock()
+	return feedControl.paused[feedID(site, name)]
+}
+
+// feedRemoved reports whether a feed has been unfollowed since the pollers read it.
+func feedRemoved(site string, name string) bool {
+	feedControl.RLock()
+	defer feedControl.RUnlock()
+	return feedControl.removed[feedID(site, name)]
+}
+
+// forgetRemovedFeed clears a feed's unfollowed mark, once its poller has dropped it or it's followed again.
+func forgetRemovedFeed(site string, name string) {
+	feedControl.Lock()
+	defer feedControl.Unlock()
+	delete(feedControl.removed, feedID(site, name))
+}
+
+// feedToken returns a short token identifying a feed by its name, for use in callback data, which Telegram limits to 64 bytes.
+// It's derived from the name rather than the feed's place in a list, so a button can't act on another feed if the feeds change before it's pressed.
+func feedToken(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
+
+// findFeedByToken returns the name of a site's followed feed from its feedToken, or errNotFound.
+func findFeedByToken(site streamablePost, token string) (string, error) {
+	feeds, err := site.getFeeds()
+	if err != nil {
+		return "", err
+	}
+	for _, feed := range feeds {
+		if feedToken(feed.Name) == token {
+			return feed.Name, nil
+		}
+	}
+	return "", errNotFound
+}
+
+// findFeed returns a followed feed of a site by name, or errNotFound.
+func findFeed(site streamablePost, name string) (feedSummary, error) {
+	feeds, err := site.getFeeds()
+	if err != nil {
+		return feedSummary{}, err
+	}
+	for _, feed := range feeds {
+		if feed.Name == name {
+			return feed, nil
+		}
+	}
+	return feedSummary{}, errNotFound
+}
+
+// pauseFeed stops or restarts polling a feed, saving the change to the store.
+func pauseFeed(site streamablePost, name string, paused bool) error {
+	_, err := findFeed(site, name)
+	if err != nil {
+		return err
+	}
+	err = site.setFeedPaused(name, paused)
+	if err != nil {
+		return err
+	}
+
+	feedControl.Lock()
+	defer feedControl.Unlock()
+	if paused {
+		feedControl.paused[feedID(site.siteName(), name)] = true
+	} else {
+		delete(feedControl.paused, feedID(site.siteName(), name))
+	}
+	return nil
+}
+
+// unfollowFeed removes a feed from the store, and tells the pollers to drop it.
+func unfollowFeed(site streamablePost, name string) error {
+	_, err := findFeed(site, name)
+	if err != nil {
+		return err
+	}
+	err = site.removeFeed(name)
+	if err != nil {
+		return err
+	}
+
+	feedControl.Lock()
+	defer feedControl.Unlock()
+	feedControl.removed[feedID(site.siteName(), name)] = true
+	delete(feedControl.paused, feedID(site.siteName(), name))
+	return nil
+}
+
+// formatFeeds lists every followed feed with its last poll time and post count, for the telegram chat.
+func formatFeeds() (string, error) {
+	var builder strings.Builder
+	for _, site := range siteTypes {
+		feeds, err := site.getFeeds()
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s feeds: %w", site.prettySiteName(), err)
+		}
+		if len(feeds) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&builder, "%s:\n", site.prettySiteName())
+		for _, feed := range feeds {
+			polled := "never polled"
+			if !feed.LastQueryTime.IsZero() {
+				polled = fmt.Sprintf("polled %s ago", time.Since(feed.LastQueryTime).Round(time.Second))
+			}
+			flags := ""
+			if feed.Paused {
+				flags += " (paused)"
+			}
+			if feed.Hot {
+				flags += " (hot)"
+			}
+			interval := ""
+			if feed.Interval > 0 {
+				interval = fmt.Sprintf(", every %s", feed.Interval.Round(time.Second))
+			}
+			fmt.Fprintf(&builder, "• %s%s - %s, %d posts%s\n", feed.Name, flags, polled, feed.PostCount, interval)
+		}
+	}
+
+	if builder.Len() == 0 {
+		return "I'm not following any feeds. Use /follow to add one.", nil
+	}
+	return builder.String(), nil
+}
+
+// feedPicker builds an inline keyboard with a button for each feed that include returns true for.
+// Pressing a button sends the callback "button site token", with the feed's feedToken. It returns false if there are no such feeds.
+func feedPicker(button string, include func(feedSummary) bool) (tgbotapi.InlineKeyboardMarkup, bool, error) {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, site := range siteTypes {
+		feeds, err := site.getFeeds()
+		if err != nil {
+			return tgbotapi.InlineKeyboardMarkup{}, false, fmt.Errorf("failed to read %s feeds: %w", site.prettySiteName(), err)
+		}
+		for _, feed := range feeds {
+			if !include(feed) {
+				continue
+			}
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%s %s", site.prettySiteName(), feed.Name),
+				fmt.Sprintf("%s %s %s", button, site.siteName(), feedToken(feed.Name)),
+			)))
+		}
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...), len(rows) > 0, nil
+}
+
+// feedCommand handles the arguments of /unfollow, /pause and /resume, returning the reply.
+// With "site feed" the change is made straight away. With no arguments, a picker of the feeds it applies to is sent instead.
+func feedCommand(chatID int64, command string, arguments []string) tgbotapi.MessageConfig {
+	var button, verb string
+	var include func(feedSummary) bool
+	switch command {
+	case "unfollow":
+		button, verb = "cb_unfollow", "unfollow"
+		include = func(feedSummary) bool { return true }
+	case "pause":
+		button, verb = "cb_pause", "pause"
+		include = func(feed feedSummary) bool { return !feed.Paused }
+	case "resume":
+		button, verb = "cb_resume", "resume"
+		include = func(feed feedSummary) bool { return feed.Paused }
+	}
+
+	if len(arguments) == 0 {
+		keyboard, ok, err := feedPicker(button, include)
+		if err != nil {
+			return tgbotapi.NewMessage(chatID, fmt.Sprintf("Sorry, I couldn't read the feeds.\nError: %s", err))
+		}
+		if !ok {
+			return tgbotapi.NewMessage(chatID, fmt.Sprintf("There are no feeds to %s.", verb))
+		}
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Which feed do you want to %s?", verb))
+		msg.ReplyMarkup = keyboard
+		return msg
+	}
+	if len(arguments) != 2 {
+		return tgbotapi.NewMessage(chatID, "Sorry, I don't know how to parse those parameters. Check /help for usage.")
+	}
+	return tgbotapi.NewMessage(chatID, applyFeedCommand(button, arguments[0], arguments[1]))
+}
+
+// applyFeedButton unfollows, pauses or resumes the feed picked with a button from feedPicker, returning the reply.
+func applyFeedButton(button string, siteArg string, token string) string {
+	site, err := parseSiteName(siteArg)
+	if err != nil {
+		return "Sorry, I don't recognise that site. Check /help for the implemented sites."
+	}
+	name, err := findFeedByToken(site, token)
+	if errors.Is(err, errNotFound) {
+		return fmt.Sprintf("Sorry, I'm not following that feed on %s any more.", site.prettySiteName())
+	} else if err != nil {
+		return fmt.Sprintf("Sorry, I couldn't read the feeds.\nError: %s", err)
+	}
+	return applyFeedCommand(button, siteArg, name)
+}
+
+// applyFeedCommand unfollows, pauses or resumes a feed for a picker button or command, returning the reply.
+func applyFeedCommand(button string, siteArg string, name string) string {
+	site, err := parseSiteName(siteArg)
+	if err != nil {
+		return "Sorry, I don't recognise that site. Check /help for the implemented sites."
+	}
+
+	var done string
+	switch button {
+	case "cb_unfollow":
+		err = unfollowFeed(site, name)
+		done = "Unfollowed"
+	case "cb_pause":
+		err = pauseFeed(site, name, true)
+		done = "Paused"
+	case "cb_resume":
+		err = pauseFeed(site, name, false)
+		done = "Resumed"
+	}
+
+	if errors.Is(err, errNotFound) {
+		return fmt.Sprintf("Sorry, I'm not following %s on %s.", name, site.prettySiteName())
+	} else if err != nil {
+		return fmt.Sprintf("Sorry, I couldn't change %s on %s.\nError: %s", name, site.prettySiteName(), err)
+	}
+	return fmt.Sprintf("%s %s on %s.", done, name, site.prettySiteName())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Telegram's limit on the length of callback data, in bytes.
+const callbackDataLimit = 64
+
+// setUpFeeds follows a feed of each given DeviantArt name and twitter username in an empty memory store.
+func setUpFeeds(t *testing.T, dANames []string, twitterNames []string) {
+	conf = defaultConfig()
+	db = newMemoryStore()
+	dASchedule = newFeedScheduler()
+	for _, name := range dANames {
+		feed, err := parseDAFeedKey(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.insertDAFeed(feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range twitterNames {
+		err := db.insertTwitterFeed(twitterFeed{Username: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := loadFeedControl()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pickerButtons returns the callback data of each button in a feed picker, by button text.
+func pickerButtons(t *testing.T, button string, include func(feedSummary) bool) map[string]string {
+	keyboard, _, err := feedPicker(button, include)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buttons := make(map[string]string)
+	for _, row := range keyboard.InlineKeyboard {
+		for _, b := range row {
+			buttons[b.Text] = *b.CallbackData
+		}
+	}
+	return buttons
+}
+
+// pressFeedButton handles a feed picker's callback data as the bot does.
+func pressFeedButton(t *testing.T, data string) string {
+	fields := strings.Fields(data)
+	if len(fields) != 3 {
+		t.Fatalf("callback data %q doesn't have 3 fields", data)
+	}
+	return applyFeedButton(fields[0], fields[1], fields[2])
+}
+
+func TestFeedPicker(t *testing.T) {
+	long := "folder/" + strings.Repeat("someartist", 3) + "/" + strings.Repeat("commissions-and-adopts-", 3)
+	setUpFeeds(t, []string{"tag/adopt", long}, []string{"someone"})
+
+	buttons := pickerButtons(t, "cb_unfollow", func(feedSummary) bool { return true })
+	if len(buttons) != 3 {
+		t.Fatalf("got buttons %v, want one for each feed", buttons)
+	}
+	for text, data := range buttons {
+		if len(data) > callbackDataLimit {
+			t.Errorf("callback data %q of button %q is longer than %d bytes", data, text, callbackDataLimit)
+		}
+	}
+
+	reply := pressFeedButton(t, strings.Replace(buttons["DeviantArt "+long], "cb_unfollow", "cb_pause", 1))
+	if reply != "Paused "+long+" on DeviantArt." {
+		t.Errorf("pausing replied %q", reply)
+	}
+	if !feedPaused("deviantart", long) || feedPaused("deviantart", "tag/adopt") {
+		t.Error("pausing didn't pause only the picked feed")
+	}
+	paused := pickerButtons(t, "cb_resume", func(feed feedSummary) bool { return feed.Paused })
+	if len(paused) != 1 || paused["DeviantArt "+long] == "" {
+		t.Errorf("got resume buttons %v, want only the paused feed", paused)
+	}
+
+	reply = pressFeedButton(t, buttons["Twitter someone"])
+	if reply != "Unfollowed someone on Twitter." {
+		t.Errorf("unfollowing replied %q", reply)
+	}
+	// A picker sent before the feed was unfollowed doesn't act on another feed.
+	reply = pressFeedButton(t, buttons["Twitter someone"])
+	if reply != "Sorry, I'm not following that feed on Twitter any more." {
+		t.Errorf("pressing a stale button replied %q", reply)
+	}
+}
+
+func TestFeedPickerCompoundQuery(t *testing.T) {
+	setUpFeeds(t, nil, nil)
+	feed, err := parseDAQuery("tag", "open commissions | ych auction | adoptables for sale | character design @someartist @anotherartist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.insertDAFeed(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := dAFeedKey(feed)
+
+	buttons := pickerButtons(t, "cb_pause", func(feedSummary) bool { return true })
+	data := buttons["DeviantArt "+name]
+	if data == "" || len(data) > callbackDataLimit {
+		t.Fatalf("got callback data %q for a %d byte feed name, want at most %d bytes", data, len(name), callbackDataLimit)
+	}
+	reply := pressFeedButton(t, data)
+	if reply != "Paused "+name+" on DeviantArt." || !feedPaused("deviantart", name) {
+		t.Errorf("pausing replied %q, want the compound feed paused", reply)
+	}
+
+	stored, err := db.getDAFeeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || len(stored[0].Terms) != 4 || len(stored[0].Authors) != 2 {
+		t.Errorf("got feeds %+v, want the terms and authors kept", stored)
+	}
+}
+
+func TestFeedTokenStable(t *testing.T) {
+	if feedToken("tag/adopt") != feedToken("tag/adopt") {
+		t.Error("a feed's token changed between calls")
+	}
+	if feedToken("tag/adopt") == feedToken("tag/adopts") {
+		t.Error("different feeds have the same token")
+	}
+}
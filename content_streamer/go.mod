@@ -4,6 +4,7 @@ go 1.17
 
 require (
 	github.com/go-telegram-bot-api/telegram-bot-api v4.6.4+incompatible
+	go.etcd.io/bbolt v1.3.7
 	go.mongodb.org/mongo-driver v1.11.0
 	gopkg.in/yaml.v2 v2.4.0
 	jaytaylor.com/html2text v0.0.0-20211105163654-bc68cce691ba
@@ -25,5 +26,6 @@ require (
 	golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d // indirect
 	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	golang.org/x/sys v0.4.0 // indirect
 	golang.org/x/text v0.3.7 // indirect
 )
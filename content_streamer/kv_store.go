@@ -0,0 +1,472 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// kvBackend is a minimal key-value database, grouped into named collections.
+type kvBackend interface {
+	get(collection string, key string) ([]byte, error) // Returns errNotFound if the key is missing.
+	put(collection string, key string, value []byte) error
+	delete(collection string, key string) error
+	forEach(collection string, fn func(key string, value []byte) error) error // Iterates in key order. fn must not modify the backend.
+	close() error
+}
+
+// kvStore implements store on top of a kvBackend, storing each document as BSON so the same struct tags are used as in MongoDB.
+type kvStore struct {
+	sync.Mutex // Guards read-modify-write updates.
+	kv         kvBackend
+}
+
+// newBoltStore opens (or creates) a single-file bbolt database at path.
+func newBoltStore(path string) (*kvStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &kvStore{kv: boltBackend{db}}, nil
+}
+
+// newMemoryStore creates an empty store that lives only as long as the process.
+func newMemoryStore() *kvStore {
+	return &kvStore{kv: &memoryBackend{collections: make(map[string]map[string][]byte)}}
+}
+
+// getDocument decodes the document at key into result.
+func (s *kvStore) getDocument(collection string, key string, result interface{}) error {
+	value, err := s.kv.get(collection, key)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(value, result)
+}
+
+// putDocument encodes document and stores it at key.
+func (s *kvStore) putDocument(collection string, key string, document interface{}) error {
+	value, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return s.kv.put(collection, key, value)
+}
+
+// setFields updates the given fields of the document at key, leaving the others intact.
+func (s *kvStore) setFields(collection string, key string, fields bson.M) error {
+	s.Lock()
+	defer s.Unlock()
+
+	document := bson.M{}
+	err := s.getDocument(collection, key, &document)
+	if err != nil {
+		return err
+	}
+	for field, value := range fields {
+		document[field] = value
+	}
+	return s.putDocument(collection, key, document)
+}
+
+func (s *kvStore) insertPost(post streamablePost, feed string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	collection := postCollection(post.siteName())
+	// Posts are downloaded more than once, so leave existing ones alone apart from their feeds.
+	document := bson.M{}
+	err := s.getDocument(collection, post.getID(), &document)
+	inserted := errors.Is(err, errNotFound)
+	if inserted {
+		document, err = postDocument(post)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	changed := inserted
+	if feed != "" {
+		feeds, _ := document["feeds"].(bson.A)
+		found := false
+		for _, existing := range feeds {
+			found = found || existing == feed
+		}
+		if !found {
+			document["feeds"] = append(feeds, feed)
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	return inserted, s.putDocument(collection, post.getID(), document)
+}
+
+func (s *kvStore) postNotified(site string, id string) (bool, error) {
+	document := bson.M{}
+	err := s.getDocument(postCollection(site), id, &document)
+	if err != nil {
+		return false, err
+	}
+	_, ok := document["notified_at"]
+	return ok, nil
+}
+
+func (s *kvStore) markPostNotified(site string, id string) error {
+	return s.setFields(postCollection(site), id, bson.M{"notified_at": time.Now()})
+}
+
+func (s *kvStore) getPost(site string, id string) (streamablePost, error) {
+	siteType, err := parseSiteName(site)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.kv.get(postCollection(site), id)
+	if err != nil {
+		return nil, err
+	}
+	return siteType.decodeDBResult(func(result interface{}) error {
+		return bson.Unmarshal(value, result)
+	})
+}
+
+func (s *kvStore) deletePost(site string, id string) error {
+	return s.kv.delete(postCollection(site), id)
+}
+
+func (s *kvStore) updatePostNotify(site string, id string, notification bool) error {
+	return s.setFields(postCollection(site), id, bson.M{"notify": notification})
+}
+
+// dAFeedKey returns the key of a DeviantArt feed, which is unique by type and query.
+func dAFeedKey(feed dAFeed) string {
+	return feed.FeedType + "/" + feed.Query
+}
+
+func (s *kvStore) getRecentDeviations(since int64) ([]deviation, error) {
+	var deviations []deviation
+	err := s.kv.forEach(postCollection("deviantart"), func(_ string, value []byte) error {
+		var d deviation
+		err := bson.Unmarshal(value, &d)
+		if err != nil {
+			return err
+		}
+		if d.PublishedTime >= since {
+			deviations = append(deviations, d)
+		}
+		return nil
+	})
+	return deviations, err
+}
+
+func (s *kvStore) addDeviationRevision(d deviation, previous dARevision) error {
+	s.Lock()
+	defer s.Unlock()
+
+	collection := postCollection("deviantart")
+	var stored deviation
+	err := s.getDocument(collection, d.Deviationid, &stored)
+	if err != nil {
+		return err
+	}
+	revisions := append(stored.Revisions, previous)
+	if len(revisions) > revisionHistory {
+		revisions = revisions[len(revisions)-revisionHistory:]
+	}
+
+	document := bson.M{}
+	err = s.getDocument(collection, d.Deviationid, &document)
+	if err != nil {
+		return err
+	}
+	document["title"] = d.Title
+	document["description"] = d.Description
+	document["tags"] = d.Tags
+	document["commission"] = d.Commission
+	document["revisions"] = revisions
+	delete(document, "notified_at")
+	return s.putDocument(collection, d.Deviationid, document)
+}
+
+func (s *kvStore) getDAFeeds() ([]dAFeed, error) {
+	var feeds []dAFeed
+	err := s.kv.forEach(deviantartFeedCollection, func(_ string, value []byte) error {
+		var feed dAFeed
+		err := bson.Unmarshal(value, &feed)
+		feeds = append(feeds, feed)
+		return err
+	})
+	return feeds, err
+}
+
+func (s *kvStore) insertDAFeed(feed dAFeed) error {
+	return s.putDocument(deviantartFeedCollection, dAFeedKey(feed), feed)
+}
+
+func (s *kvStore) updateDAFeed(feed dAFeed) error {
+	return s.setFields(deviantartFeedCollection, dAFeedKey(feed), bson.M{"last_query_time": feed.LastQueryTime, "last_post_time": feed.LastPostTime, "new_feed": feed.NewFeed, "post_count": feed.PostCount, "recent_post_times": feed.RecentPostTimes})
+}
+
+func (s *kvStore) setDAFeedPaused(feed dAFeed, paused bool) error {
+	return s.setFields(deviantartFeedCollection, dAFeedKey(feed), bson.M{"paused": paused})
+}
+
+func (s *kvStore) setDAFeedHot(feed dAFeed, hot bool) error {
+	return s.setFields(deviantartFeedCollection, dAFeedKey(feed), bson.M{"hot": hot})
+}
+
+func (s *kvStore) addDAFeedPositive(feed dAFeed, at int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var stored dAFeed
+	err := s.getDocument(deviantartFeedCollection, dAFeedKey(feed), &stored)
+	if err != nil {
+		return err
+	}
+	stored.Positives = trimHistory(append(stored.Positives, at))
+	return s.putDocument(deviantartFeedCollection, dAFeedKey(feed), stored)
+}
+
+func (s *kvStore) deleteDAFeed(feed dAFeed) error {
+	return s.kv.delete(deviantartFeedCollection, dAFeedKey(feed))
+}
+
+func (s *kvStore) getTwitterFeeds() ([]twitterFeed, error) {
+	var feeds []twitterFeed
+	err := s.kv.forEach(twitterFeedCollection, func(_ string, value []byte) error {
+		var feed twitterFeed
+		err := bson.Unmarshal(value, &feed)
+		feeds = append(feeds, feed)
+		return err
+	})
+	return feeds, err
+}
+
+func (s *kvStore) insertTwitterFeed(feed twitterFeed) error {
+	return s.putDocument(twitterFeedCollection, feed.Username, feed)
+}
+
+func (s *kvStore) updateTwitterFeed(feed twitterFeed) error {
+	return s.setFields(twitterFeedCollection, feed.Username, bson.M{"user_id": feed.UserID, "last_query_time": feed.LastQueryTime, "last_post_time": feed.LastPostTime, "last_post_id": feed.LastPostID, "post_count": feed.PostCount})
+}
+
+func (s *kvStore) setTwitterFeedPaused(username string, paused bool) error {
+	return s.setFields(twitterFeedCollection, username, bson.M{"paused": paused})
+}
+
+func (s *kvStore) deleteTwitterFeed(username string) error {
+	return s.kv.delete(twitterFeedCollection, username)
+}
+
+func (s *kvStore) getQueueEntry(key string) (queueEntry, error) {
+	var entry queueEntry
+	err := s.getDocument(queueCollection, key, &entry)
+	return entry, err
+}
+
+func (s *kvStore) getQueueEntries() ([]queueEntry, error) {
+	var entries []queueEntry
+	err := s.kv.forEach(queueCollection, func(_ string, value []byte) error {
+		var entry queueEntry
+		err := bson.Unmarshal(value, &entry)
+		entries = append(entries, entry)
+		return err
+	})
+	// The backend iterates in key order, so sort to match MongoDB.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Queued.Before(entries[j].Queued)
+	})
+	return entries, err
+}
+
+func (s *kvStore) putQueueEntry(entry queueEntry) error {
+	return s.putDocument(queueCollection, entry.Key, entry)
+}
+
+func (s *kvStore) deleteQueueEntry(key string) error {
+	return s.kv.delete(queueCollection, key)
+}
+
+func (s *kvStore) getThresholds() ([]threshold, error) {
+	var thresholds []threshold
+	err := s.kv.forEach(thresholdCollection, func(_ string, value []byte) error {
+		var t threshold
+		err := bson.Unmarshal(value, &t)
+		thresholds = append(thresholds, t)
+		return err
+	})
+	return thresholds, err
+}
+
+func (s *kvStore) putThreshold(t threshold) error {
+	return s.putDocument(thresholdCollection, t.Key, t)
+}
+
+func (s *kvStore) deleteThreshold(key string) error {
+	return s.kv.delete(thresholdCollection, key)
+}
+
+func (s *kvStore) getReminders() ([]reminder, error) {
+	var reminders []reminder
+	err := s.kv.forEach(reminderCollection, func(_ string, value []byte) error {
+		var r reminder
+		err := bson.Unmarshal(value, &r)
+		reminders = append(reminders, r)
+		return err
+	})
+	return reminders, err
+}
+
+func (s *kvStore) putReminder(r reminder) error {
+	return s.putDocument(reminderCollection, r.Key, r)
+}
+
+func (s *kvStore) deleteReminder(key string) error {
+	return s.kv.delete(reminderCollection, key)
+}
+
+func (s *kvStore) getRules() ([]rule, error) {
+	var rules []rule
+	err := s.kv.forEach(ruleCollection, func(_ string, value []byte) error {
+		var r rule
+		err := bson.Unmarshal(value, &r)
+		rules = append(rules, r)
+		return err
+	})
+	return rules, err
+}
+
+func (s *kvStore) putRule(r rule) error {
+	return s.putDocument(ruleCollection, ruleKey(r.ID), r)
+}
+
+func (s *kvStore) deleteRule(id int) error {
+	return s.kv.delete(ruleCollection, ruleKey(id))
+}
+
+func (s *kvStore) close() error {
+	return s.kv.close()
+}
+
+// boltBackend implements kvBackend with a bucket per collection in a bbolt file.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+func (b boltBackend) get(collection string, key string) (value []byte, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(collection))
+		if bucket == nil {
+			return errNotFound
+		}
+		stored := bucket.Get([]byte(key))
+		if stored == nil {
+			return errNotFound
+		}
+		// Values are only valid inside the transaction, so copy it out.
+		value = append([]byte(nil), stored...)
+		return nil
+	})
+	return
+}
+
+func (b boltBackend) put(collection string, key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(collection))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+func (b boltBackend) delete(collection string, key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (b boltBackend) forEach(collection string, fn func(key string, value []byte) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key []byte, value []byte) error {
+			return fn(string(key), value)
+		})
+	})
+}
+
+func (b boltBackend) close() error {
+	return b.db.Close()
+}
+
+// memoryBackend implements kvBackend with maps. Nothing is persisted.
+type memoryBackend struct {
+	sync.RWMutex
+	collections map[string]map[string][]byte
+}
+
+func (m *memoryBackend) get(collection string, key string) ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+	value, ok := m.collections[collection][key]
+	if !ok {
+		return nil, errNotFound
+	}
+	return value, nil
+}
+
+func (m *memoryBackend) put(collection string, key string, value []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.collections[collection] == nil {
+		m.collections[collection] = make(map[string][]byte)
+	}
+	m.collections[collection][key] = value
+	return nil
+}
+
+func (m *memoryBackend) delete(collection string, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.collections[collection], key)
+	return nil
+}
+
+func (m *memoryBackend) forEach(collection string, fn func(key string, value []byte) error) error {
+	// Copy the collection so fn can modify the backend.
+	m.RLock()
+	keys := make([]string, 0, len(m.collections[collection]))
+	values := make(map[string][]byte, len(m.collections[collection]))
+	for key, value := range m.collections[collection] {
+		keys = append(keys, key)
+		values[key] = value
+	}
+	m.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		err := fn(key, values[key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryBackend) close() error {
+	return nil
+}
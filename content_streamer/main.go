@@ -5,38 +5,28 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"gopkg.in/yaml.v2"
 )
 
 // Configuration constants.
 const mongoConnectTimeout = 5 * time.Second
-const databaseName = "adopt-detector-DB" // Database name in MongoDB.
-const keyFileName = "../keys.yaml"       // YAML file containing keys for linked sites.
-
-// Probability function threshold for notification. Between 0 and 1.
-const POST_NOTIFICATION_THRESHOLD = -0.1
+const defaultConfigFileName = "../keys.yaml" // YAML file containing keys for linked sites and other settings.
 
 // Global shared objects.
-// var shutdownWG sync.WaitGroup
-// var cleanupWG sync.WaitGroup
-var keys map[interface{}]interface{}
+var conf config
 var telegramBot *tgbotapi.BotAPI
-var chatID int64 // Drawn from keys.
-var database *mongo.Database
+var chatID int64 // Drawn from config.
+var db store
 var debug = false
 
 // siteTypes stores a list of nil pointers of each type implementing streamablePost to generalise certain operations.
@@ -44,15 +34,21 @@ var siteTypes = [...]streamablePost{deviation{}, tweet{}}
 
 // streamablePost represents a post from a website that can be downloaded in a "streamed".
 type streamablePost interface {
-	createDownloadStream(downloadQueue chan<- postMessage, workers int) // Stream posts from the site and put them into the channel.
-	formatLink() string                                                 // Format a link to the post.
-	formatPost() string                                                 // Formats the post in HTML.
-	siteName() string                                                   // Return a computer-ready version of the site name (lowercase, no hypens etc.)
-	prettySiteName() string                                             // Return a pretty version of the site name (e.g. with capitalisation)
-	getID() string                                                      // Return the field used as "_id" in the mongodb database.
-	addFollowHandler() func(tgbotapi.Update) (bool, interface{})        // Start the process of adding a follow through the telegram bot.
-	downloadPost(string) (postMessage, error)                           // Download and return a post based on its' ID.
-	decodeDBResult(*mongo.SingleResult) (streamablePost, error)         //Decode a result from the database.
+	createDownloadStream(ctx context.Context, downloadQueue chan<- postMessage, workers int) error // Stream posts from the site and put them into the channel until ctx is cancelled.
+	formatLink() string                                                                            // Format a link to the post.
+	formatPost() string                                                                            // Formats the post in HTML.
+	formatCaption() string                                                                         // Format the post's title, author and tags as Telegram HTML, for its notification.
+	previewImage() string                                                                          // Return the URL of an image previewing the post, or "" if it has none.
+	siteName() string                                                                              // Return a computer-ready version of the site name (lowercase, no hypens etc.)
+	prettySiteName() string                                                                        // Return a pretty version of the site name (e.g. with capitalisation)
+	getID() string                                                                                 // Return the field used as "_id" in the mongodb database.
+	filterFields() postFields                                                                      // Return the parts of the post that rules match against.
+	addFollowHandler(chatID int64) stepHandler                                                     // Start the process of adding a follow through the telegram bot.
+	getFeeds() ([]feedSummary, error)                                                              // List the site's followed feeds.
+	setFeedPaused(name string, paused bool) error                                                  // Pause or resume a feed in the database.
+	removeFeed(name string) error                                                                  // Remove a feed from the database.
+	downloadPost(string) (postMessage, error)                                                      // Download and return a post based on its' ID.
+	decodeDBResult(decode func(interface{}) error) (streamablePost, error)                         // Decode a result from the database using its decode function.
 }
 
 func BoolPointer(b bool) *bool {
@@ -63,6 +59,8 @@ type postMessage struct {
 	post      streamablePost // Post passed in message.
 	setNotify *bool          // When not null, will be used in place of notification value.
 	skipWrite bool           // When set, skip writing to database.
+	feed      string         // Name of the feed the post came from, if any. See feedNames.
+	edit      string         // The parts of the post that changed, if it's queued again because it was edited.
 }
 
 // TODO: Decide if necessary.
@@ -91,79 +89,135 @@ type postMessage struct {
 // }
 
 // databaseWriter defines a goroutine that reads from the download queue, adds each post to the database, then passes it to the notify queue.
-func databaseWriter(postWriteQueue <-chan postMessage, postNotifyQueue chan<- postMessage) {
+// Each post is recorded in the store's post queue before it's passed on, so it can be resumed if the program stops.
+// Posts surfaced by more than one feed are only passed on the first time, but every feed is recorded on the post.
+// It returns once the download queue is closed and drained.
+func databaseWriter(postWriteQueue <-chan postMessage, postNotifyQueue chan<- postMessage) error {
 
 	log.Println("Started database writer.")
 
 	for message := range postWriteQueue {
+		post := message.post
 		// If the skipWrite flag is set, skip the write step and just send it to the classifier.
-		if message.skipWrite {
-			// Send request to classifier
-			postNotifyQueue <- message
+		if !message.skipWrite {
+			// Add post to the appropriate collection.
+			if debug {
+				log.Printf("Added %s\n", post.formatLink())
+			}
+			inserted, err := db.insertPost(post, message.feed)
+			if err != nil {
+				return fmt.Errorf("failed to write post %s: %w", post.getID(), err)
+			}
+			// Posts already seen have been classified, or are queued to be, unless they were asked for from the chat.
+			forced := message.setNotify != nil && *message.setNotify
+			if !inserted && !forced {
+				if debug {
+					log.Printf("Skipped duplicate %s from feed %s\n", post.formatLink(), message.feed)
+				}
+				continue
+			}
+		}
+
+		// Posts that won't be notified don't need to be queued.
+		if message.setNotify != nil && !(*message.setNotify) {
 			continue
 		}
-		post := message.post
-		// Add post to the appropriate collection.
-		if debug {
-			log.Printf("Added %s\n", post.formatLink())
+		err := db.putQueueEntry(newQueueEntry(message))
+		if err != nil {
+			return fmt.Errorf("failed to queue post %s: %w", post.getID(), err)
 		}
-		collection := database.Collection(fmt.Sprintf("%sPosts", post.siteName()))
-		collection.InsertOne(context.TODO(), post)
 		// Send request to classifier
 		postNotifyQueue <- message
 	}
-}
-
-// Struct to store results from the classifier.
-type classificationResult struct {
-	Success          bool
-	Error            string
-	ErrorDescription string `json:"error_description"`
-	ID               string
-	Site             string
-	Notify           bool
-	Score            float64
-}
-
-func classifyPost(post streamablePost) classificationResult {
-	// Send web request to the python script
-	params := url.Values{}
-	params.Add("id", post.getID())
-	params.Add("site", post.siteName())
-	requestParams := params.Encode()
-	resp, err := http.Get(fmt.Sprintf("http://localhost:5000/classify?%s", requestParams))
-	if err != nil {
-		log.Panicln(err)
-	}
-	// Decode the results
-	var result classificationResult
-
-	json.NewDecoder(resp.Body).Decode(&result)
-	return result
+	return nil
 }
 
 // postNotifier defines a goroutine that reads from the notify queue, classifies it using the python webhook, and then notifies the user if positive.
-func postNotifier(postNotifyQueue <-chan postMessage) {
+// Posts are collected into batches, which are classified once full or once the batch window has passed.
+// On starting, it resumes any posts left in the store's post queue. Posts held while the classifier is unavailable are retried whenever a health probe succeeds.
+// It returns once the notify queue is closed and drained, or ctx is cancelled.
+func postNotifier(ctx context.Context, postNotifyQueue <-chan postMessage) error {
 
 	log.Println("Started post notifier.")
 
-	for message := range postNotifyQueue {
-		post := message.post
+	err := resumeQueue(ctx)
+	if err != nil {
+		return err
+	}
 
-		// If setNotify is false, skip classification.
-		if message.setNotify != nil && !(*message.setNotify) {
-			continue
-		}
+	healthCheck := time.NewTicker(conf.Classifier.HealthInterval)
+	defer healthCheck.Stop()
 
-		result := classifyPost(post)
+	var batch []queuedPost
+	batchKeys := make(map[string]bool)
+	var batchTimer <-chan time.Time // Fires once the batch window has passed. Nil while the batch is empty.
 
-		if !result.Success {
-			log.Printf("Error in classifier. Type: %s\n%s\n", result.Error, result.ErrorDescription)
-		}
+	flush := func() error {
+		err := advanceQueue(ctx, batch)
+		batch = nil
+		batchKeys = make(map[string]bool)
+		batchTimer = nil
+		return err
+	}
 
-		// Send post if score is above threshold, or if setNotify overrides to True.
-		if (result.Score > POST_NOTIFICATION_THRESHOLD) || ((message.setNotify != nil) && (*message.setNotify)) {
-			sendPost(post, result.Score)
+	for {
+		select {
+		case message, ok := <-postNotifyQueue:
+			if !ok {
+				return flush()
+			}
+			post := message.post
+			key := queueKey(post.siteName(), post.getID())
+			if batchKeys[key] {
+				continue
+			}
+
+			// The post may have already been handled by resumeQueue. If it's being held for the classifier, leave it for the health check.
+			entry, err := db.getQueueEntry(key)
+			if errors.Is(err, errNotFound) || (err == nil && (entry.Stage == queueStageDead || entry.Attempts > 0)) {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("failed to read queued post %s: %w", post.getID(), err)
+			}
+
+			batch = append(batch, queuedPost{entry: entry, post: post})
+			batchKeys[key] = true
+			if batchTimer == nil {
+				batchTimer = time.After(conf.Classifier.BatchWindow)
+			}
+			if len(batch) >= conf.Classifier.BatchSize {
+				err = flush()
+				if err != nil {
+					return err
+				}
+			}
+
+		case <-batchTimer:
+			err := flush()
+			if err != nil {
+				return err
+			}
+
+		case <-healthCheck.C:
+			pending, err := hasPendingQueueEntries()
+			if err != nil {
+				return fmt.Errorf("failed to read the post queue: %w", err)
+			}
+			if !pending || classifier.status(ctx) != nil {
+				continue
+			}
+			// Finish the current batch first, so resumeQueue doesn't handle its posts twice.
+			err = flush()
+			if err != nil {
+				return err
+			}
+			err = resumeQueue(ctx)
+			if err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }
@@ -173,6 +227,7 @@ func main() {
 	// Define command-line options.
 	// var init = flag.Bool("init", false, "Initalise all necessary databases and files.")
 	var debugFlag = flag.Bool("debug", false, "Log more information to the terminal.")
+	var configFlag = flag.String("config", defaultConfigFileName, "Path to the YAML config file.")
 
 	// Parse flags
 	flag.Parse()
@@ -183,87 +238,133 @@ func main() {
 		log.Println("Running in debug mode.")
 	}
 
-	// Load keys into memory
-	keyFile, err := os.Open(keyFileName)
+	// Load config into memory.
+	var err error
+	conf, err = loadConfig(*configFlag)
 	if err != nil {
-		log.Panicln(err)
+		log.Fatalln(err)
 	}
-	keyBytes, _ := ioutil.ReadAll(keyFile)
-	yaml.Unmarshal(keyBytes, &keys)
-	keyFile.Close()
-
-	// Initialise a shutdown waitgroup for all processes needing shutdown to wait on.
-	// shutdownWG.Add(1) // TODO - is this necessary?
-
-	// Create telegram bot object by getting key from the key object.
-	telegramKeys := keys["telegram"].(map[interface{}]interface{})
-	apiKey := telegramKeys["api_key"].(string)
-	telegramBot, err = tgbotapi.NewBotAPI(apiKey)
-	// telegramBot, err = tgbotapi.NewBotAPI(telegramKeys["api_key"].(string))
+	log.Printf("Users in allowed chats who aren't in telegram.users have the %s role.\n", conf.Telegram.DefaultRole)
+
+	// Create telegram bot object.
+	telegramBot, err = tgbotapi.NewBotAPI(conf.Telegram.APIKey)
 	if err != nil {
-		log.Panicf("Failed to initialise Telegram bot.\n Message: %s\n", err)
-		log.Panicln(err)
+		log.Fatalf("Failed to initialise Telegram bot.\n Message: %s\n", err)
 	}
 	telegramBot.Debug = false
+	chatID = conf.Telegram.ChatID
 
-	switch g := telegramKeys["chat_id"].(type) {
-	case nil:
-		log.Panicln("Chat_id is nil.")
-	case int:
-		chatID = int64(g)
-	default:
-		log.Panicln("Telegram chat_id has unexpected type (should be int).")
+	// Connect to the database.
+	db, err = openStore(conf)
+	if err != nil {
+		log.Fatalf("Failed to open %s database.\nMessage: %s\n", conf.Store.Backend, err)
 	}
+	defer db.close()
 
-	// Connect to mongoDB database.
-	mongoOptions := options.Client().ApplyURI("mongodb://localhost:27017")
-	ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeout)
-	client, err := mongo.Connect(ctx, mongoOptions)
+	log.Printf("Connected to %s database.\n", conf.Store.Backend)
+
+	err = loadThresholds()
 	if err != nil {
-		log.Fatalf("Failed to connect to mongoDB.\nMessage: %s\n", err)
+		log.Fatalf("Failed to load notification thresholds.\nMessage: %s\n", err)
+	}
+	err = loadRules()
+	if err != nil {
+		log.Fatalf("Failed to load rules.\nMessage: %s\n", err)
+	}
+	err = loadFeedControl()
+	if err != nil {
+		log.Fatalf("Failed to load feeds.\nMessage: %s\n", err)
+	}
+
+	dAClient = newDAAPIClient(conf)
+
+	// Check the classifier is up. Posts can still be streamed while it isn't, under the fallback policy.
+	classifier = newClassifierClient(conf)
+	err = classifier.status(context.Background())
+	if err != nil {
+		log.Printf("Warning: %s. Posts will be handled with the \"%s\" fallback policy until it responds.\n", err, conf.Classifier.Fallback)
 	}
-	cancel()
-	database = client.Database(databaseName)
-	// TODO - Fix. Defer a shutdown message to send the panic to the user and then repanic.
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Sending shutdown")
-			sendShutdownMessage(r)
-			panic(r)
-		}
-	}()
 
-	log.Println("Connected to MongoDB.")
+	// Cancel the root context on Control-C, or SIGTERM from docker stop.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Make channels for passing around posts.
 	postWriteQueue := make(chan postMessage, 100)
 	postNotifyQueue := make(chan postMessage, 100)
 
-	// Spawn callback handler
-	go telegramCallbackHandler(postWriteQueue)
+	// Producers put posts into the write queue. It is closed once they have all stopped.
+	// Each runs under a supervisor which restarts it if it fails.
+	var producers sync.WaitGroup
+
+	// Spawn callback handler. Updates are received outside the handler so it can be restarted.
+	updates, err := telegramBot.GetUpdatesChan(tgbotapi.UpdateConfig{Timeout: 60})
+	if err != nil {
+		log.Fatalf("Failed to receive Telegram updates.\n Message: %s\n", err)
+	}
+	producers.Add(1)
+	go func() {
+		defer producers.Done()
+		supervise(ctx, "telegram callback handler", func(ctx context.Context) error {
+			return telegramCallbackHandler(ctx, updates, postWriteQueue)
+		})
+	}()
+
+	// Spawn the reminder sender. It doesn't write posts, but stops along with the producers.
+	producers.Add(1)
+	go func() {
+		defer producers.Done()
+		supervise(ctx, "reminder sender", reminderSender)
+	}()
 
 	// // Start webhook handler TODO - Decide if necessary
 	// go webhookHandler()
 
 	// Create a stream for each type of post to be downloaded.
 	for _, postType := range siteTypes {
-		go postType.createDownloadStream(postWriteQueue, 1)
+		producers.Add(1)
+		go func(postType streamablePost) {
+			defer producers.Done()
+			supervise(ctx, fmt.Sprintf("%s stream", postType.prettySiteName()), func(ctx context.Context) error {
+				return postType.createDownloadStream(ctx, postWriteQueue, conf.Polling.Workers)
+			})
+		}(postType)
 	}
 
-	// Spawn the writers.
-	go databaseWriter(postWriteQueue, postNotifyQueue)
-	go postNotifier(postNotifyQueue)
-
-	// Wait for Control-C and execute a safe shutdown.
-	shutdownChan := make(chan os.Signal, 1)
-	signal.Notify(shutdownChan, os.Interrupt)
+	// Spawn the writers. These run until the queues are drained, or the shutdown deadline passes.
+	drainCtx, cancelDrain := context.WithCancel(context.Background())
+	defer cancelDrain()
+	notifierDone := make(chan struct{})
+	go func() {
+		supervise(drainCtx, "database writer", func(context.Context) error {
+			return databaseWriter(postWriteQueue, postNotifyQueue)
+		})
+		close(postNotifyQueue)
+	}()
+	go func() {
+		supervise(drainCtx, "post notifier", func(ctx context.Context) error {
+			return postNotifier(ctx, postNotifyQueue)
+		})
+		close(notifierDone)
+	}()
 
-	<-shutdownChan
+	<-ctx.Done()
+	// Restore default signal handling, so a second Control-C exits immediately.
+	stop()
 	log.Println("Shutting down...")
+	telegramBot.StopReceivingUpdates()
 
-	// // Signal time to shut down.
-	// shutdownWG.Done()
-	// // Wait for cleanup to finish
-	// cleanupWG.Wait()
+	go func() {
+		producers.Wait()
+		close(postWriteQueue)
+	}()
 
+	select {
+	case <-notifierDone:
+		log.Println("Shutdown complete.")
+	case <-time.After(conf.ShutdownTimeout):
+		cancelDrain()
+		log.Printf("Shutdown timed out after %s. Abandoned %d posts waiting to be written. Posts already written will be resumed on the next start.\n",
+			conf.ShutdownTimeout, len(postWriteQueue))
+	}
 }
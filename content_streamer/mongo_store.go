@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoStore implements store on a MongoDB database.
+// This is also the database read by the ml_webhooks classifier.
+type mongoStore struct {
+	client   *mongo.Client
+	database *mongo.Database
+}
+
+func newMongoStore(uri string, databaseName string) (*mongoStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoConnectTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, err
+	}
+	// Connect doesn't wait for the server, so ping it to fail early.
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mongoStore{
+		client:   client,
+		database: client.Database(databaseName),
+	}, nil
+}
+
+// updateResult returns errNotFound if an update matched no document, as the key-value backends do.
+func updateResult(result *mongo.UpdateResult, err error) error {
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *mongoStore) insertPost(post streamablePost, feed string) (bool, error) {
+	document, err := postDocument(post)
+	if err != nil {
+		return false, err
+	}
+	update := bson.M{"$setOnInsert": document}
+	if feed != "" {
+		update["$addToSet"] = bson.M{"feeds": feed}
+	}
+
+	// Posts are downloaded more than once, so existing ones are left as they are.
+	result, err := s.database.Collection(postCollection(post.siteName())).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": post.getID()},
+		update,
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+func (s *mongoStore) postNotified(site string, id string) (bool, error) {
+	var document bson.M
+	err := s.database.Collection(postCollection(site)).FindOne(
+		context.TODO(),
+		bson.M{"_id": id},
+		options.FindOne().SetProjection(bson.M{"notified_at": 1}),
+	).Decode(&document)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, errNotFound
+	} else if err != nil {
+		return false, err
+	}
+	_, ok := document["notified_at"]
+	return ok, nil
+}
+
+func (s *mongoStore) markPostNotified(site string, id string) error {
+	return updateResult(s.database.Collection(postCollection(site)).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"notified_at": time.Now()}},
+	))
+}
+
+func (s *mongoStore) getPost(site string, id string) (streamablePost, error) {
+	siteType, err := parseSiteName(site)
+	if err != nil {
+		return nil, err
+	}
+
+	singleResult := s.database.Collection(postCollection(site)).FindOne(
+		context.TODO(),
+		bson.M{"_id": id},
+	)
+	if errors.Is(singleResult.Err(), mongo.ErrNoDocuments) {
+		return nil, errNotFound
+	}
+
+	return siteType.decodeDBResult(singleResult.Decode)
+}
+
+func (s *mongoStore) deletePost(site string, id string) error {
+	_, err := s.database.Collection(postCollection(site)).DeleteMany(
+		context.TODO(),
+		bson.M{"_id": id},
+	)
+	return err
+}
+
+func (s *mongoStore) updatePostNotify(site string, id string, notification bool) error {
+	return updateResult(s.database.Collection(postCollection(site)).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"notify": notification}},
+	))
+}
+
+func (s *mongoStore) getRecentDeviations(since int64) ([]deviation, error) {
+	var deviations []deviation
+	cursor, err := s.database.Collection(postCollection("deviantart")).Find(context.TODO(), bson.M{"published_time": bson.M{"$gte": since}})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &deviations)
+	return deviations, err
+}
+
+func (s *mongoStore) addDeviationRevision(d deviation, previous dARevision) error {
+	return updateResult(s.database.Collection(postCollection("deviantart")).UpdateOne(
+		context.TODO(),
+		bson.M{"_id": d.Deviationid},
+		bson.M{
+			"$set":   bson.M{"title": d.Title, "description": d.Description, "tags": d.Tags, "commission": d.Commission},
+			"$unset": bson.M{"notified_at": ""},
+			"$push":  bson.M{"revisions": bson.M{"$each": []dARevision{previous}, "$slice": -revisionHistory}},
+		},
+	))
+}
+
+func (s *mongoStore) getDAFeeds() ([]dAFeed, error) {
+	var feeds []dAFeed
+	cursor, err := s.database.Collection(deviantartFeedCollection).Find(context.TODO(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &feeds)
+	return feeds, err
+}
+
+// insertDAFeed replaces a feed that's already followed, so following it twice leaves one copy, as in kvStore.
+func (s *mongoStore) insertDAFeed(feed dAFeed) error {
+	_, err := s.database.Collection(deviantartFeedCollection).ReplaceOne(
+		context.TODO(),
+		bson.M{"feed_type": feed.FeedType, "query": feed.Query},
+		feed,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) updateDAFeed(feed dAFeed) error {
+	filter := bson.M{"feed_type": feed.FeedType, "query": feed.Query}
+	update := bson.M{"$set": bson.M{"last_query_time": feed.LastQueryTime, "last_post_time": feed.LastPostTime, "new_feed": feed.NewFeed, "post_count": feed.PostCount, "recent_post_times": feed.RecentPostTimes}}
+	return updateResult(s.database.Collection(deviantartFeedCollection).UpdateOne(context.TODO(), filter, update))
+}
+
+func (s *mongoStore) setDAFeedPaused(feed dAFeed, paused bool) error {
+	filter := bson.M{"feed_type": feed.FeedType, "query": feed.Query}
+	return updateResult(s.database.Collection(deviantartFeedCollection).UpdateOne(context.TODO(), filter, bson.M{"$set": bson.M{"paused": paused}}))
+}
+
+func (s *mongoStore) setDAFeedHot(feed dAFeed, hot bool) error {
+	filter := bson.M{"feed_type": feed.FeedType, "query": feed.Query}
+	return updateResult(s.database.Collection(deviantartFeedCollection).UpdateOne(context.TODO(), filter, bson.M{"$set": bson.M{"hot": hot}}))
+}
+
+func (s *mongoStore) addDAFeedPositive(feed dAFeed, at int64) error {
+	filter := bson.M{"feed_type": feed.FeedType, "query": feed.Query}
+	// Keep only the newest positives.
+	update := bson.M{"$push": bson.M{"positives": bson.M{"$each": []int64{at}, "$slice": -cadenceHistory}}}
+	return updateResult(s.database.Collection(deviantartFeedCollection).UpdateOne(context.TODO(), filter, update))
+}
+
+// deleteDAFeed removes every copy of a feed, including duplicates inserted before insertDAFeed replaced them.
+func (s *mongoStore) deleteDAFeed(feed dAFeed) error {
+	filter := bson.M{"feed_type": feed.FeedType, "query": feed.Query}
+	_, err := s.database.Collection(deviantartFeedCollection).DeleteMany(context.TODO(), filter)
+	return err
+}
+
+func (s *mongoStore) getTwitterFeeds() ([]twitterFeed, error) {
+	var feeds []twitterFeed
+	cursor, err := s.database.Collection(twitterFeedCollection).Find(
+		context.TODO(),
+		bson.D{},
+		options.Find().SetSort(bson.M{"username": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &feeds)
+	return feeds, err
+}
+
+func (s *mongoStore) insertTwitterFeed(feed twitterFeed) error {
+	_, err := s.database.Collection(twitterFeedCollection).ReplaceOne(
+		context.TODO(),
+		bson.M{"username": feed.Username},
+		feed,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) updateTwitterFeed(feed twitterFeed) error {
+	filter := bson.M{"username": feed.Username}
+	update := bson.M{"$set": bson.M{"user_id": feed.UserID, "last_query_time": feed.LastQueryTime, "last_post_time": feed.LastPostTime, "last_post_id": feed.LastPostID, "post_count": feed.PostCount}}
+	return updateResult(s.database.Collection(twitterFeedCollection).UpdateOne(context.TODO(), filter, update))
+}
+
+func (s *mongoStore) setTwitterFeedPaused(username string, paused bool) error {
+	return updateResult(s.database.Collection(twitterFeedCollection).UpdateOne(context.TODO(), bson.M{"username": username}, bson.M{"$set": bson.M{"paused": paused}}))
+}
+
+func (s *mongoStore) deleteTwitterFeed(username string) error {
+	_, err := s.database.Collection(twitterFeedCollection).DeleteMany(context.TODO(), bson.M{"username": username})
+	return err
+}
+
+func (s *mongoStore) getQueueEntry(key string) (queueEntry, error) {
+	var entry queueEntry
+	err := s.database.Collection(queueCollection).FindOne(context.TODO(), bson.M{"_id": key}).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return entry, errNotFound
+	}
+	return entry, err
+}
+
+func (s *mongoStore) getQueueEntries() ([]queueEntry, error) {
+	var entries []queueEntry
+	cursor, err := s.database.Collection(queueCollection).Find(
+		context.TODO(),
+		bson.D{},
+		options.Find().SetSort(bson.M{"queued": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &entries)
+	return entries, err
+}
+
+func (s *mongoStore) putQueueEntry(entry queueEntry) error {
+	_, err := s.database.Collection(queueCollection).ReplaceOne(
+		context.TODO(),
+		bson.M{"_id": entry.Key},
+		entry,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) deleteQueueEntry(key string) error {
+	_, err := s.database.Collection(queueCollection).DeleteOne(context.TODO(), bson.M{"_id": key})
+	return err
+}
+
+func (s *mongoStore) getThresholds() ([]threshold, error) {
+	var thresholds []threshold
+	cursor, err := s.database.Collection(thresholdCollection).Find(context.TODO(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &thresholds)
+	return thresholds, err
+}
+
+func (s *mongoStore) putThreshold(t threshold) error {
+	_, err := s.database.Collection(thresholdCollection).ReplaceOne(
+		context.TODO(),
+		bson.M{"_id": t.Key},
+		t,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) deleteThreshold(key string) error {
+	_, err := s.database.Collection(thresholdCollection).DeleteOne(context.TODO(), bson.M{"_id": key})
+	return err
+}
+
+func (s *mongoStore) getReminders() ([]reminder, error) {
+	var reminders []reminder
+	cursor, err := s.database.Collection(reminderCollection).Find(context.TODO(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &reminders)
+	return reminders, err
+}
+
+func (s *mongoStore) putReminder(r reminder) error {
+	_, err := s.database.Collection(reminderCollection).ReplaceOne(
+		context.TODO(),
+		bson.M{"_id": r.Key},
+		r,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) deleteReminder(key string) error {
+	_, err := s.database.Collection(reminderCollection).DeleteOne(context.TODO(), bson.M{"_id": key})
+	return err
+}
+
+func (s *mongoStore) getRules() ([]rule, error) {
+	var rules []rule
+	cursor, err := s.database.Collection(ruleCollection).Find(context.TODO(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(context.TODO(), &rules)
+	return rules, err
+}
+
+func (s *mongoStore) putRule(r rule) error {
+	_, err := s.database.Collection(ruleCollection).ReplaceOne(
+		context.TODO(),
+		bson.M{"_id": r.ID},
+		r,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *mongoStore) deleteRule(id int) error {
+	_, err := s.database.Collection(ruleCollection).DeleteOne(context.TODO(), bson.M{"_id": id})
+	return err
+}
+
+func (s *mongoStore) close() error {
+	return s.client.Disconnect(context.TODO())
+}
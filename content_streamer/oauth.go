@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	tokenRefreshMargin   = 5 * time.Minute // Refresh tokens this long before they expire.
+	tokenDefaultLifetime = time.Hour       // Lifetime assumed for a token whose response didn't give one.
+	tokenRetryBackoff    = time.Second     // Delay before retrying a failed refresh. Doubles on each failure.
+	tokenMaxBackoff      = 5 * time.Minute
+)
+
+// tokenFetcher requests a new OAuth access token, returning it and how long it lasts. A zero lifetime means it wasn't given.
+type tokenFetcher func(ctx context.Context) (token string, expiresIn time.Duration, err error)
+
+// tokenSource keeps an OAuth access token for a site's API client.
+// Tokens are refreshed shortly before they expire, when the API rejects them, and on demand if they've lapsed.
+// Callers that need a token at the same time share one refresh, and failed refreshes back off before trying again.
+type tokenSource struct {
+	sync.Mutex
+	name       string // Site name, for error reports.
+	fetch      tokenFetcher
+	token      string
+	expires    time.Time
+	refreshAt  time.Time     // When run next refreshes the token, shortly before it expires.
+	refreshing chan struct{} // Closed when the refresh in progress finishes. Nil if there isn't one.
+	failures   int           // Consecutive failed refreshes.
+	retryAt    time.Time     // No refresh is attempted before this after a failure.
+	lastErr    error
+}
+
+func newTokenSource(name string, fetch tokenFetcher) *tokenSource {
+	return &tokenSource{name: name, fetch: fetch}
+}
+
+// get returns a current token, refreshing it first if there isn't one.
+func (s *tokenSource) get(ctx context.Context) (string, error) {
+	s.Lock()
+	if s.token != "" && time.Now().Before(s.expires) {
+		token := s.token
+		s.Unlock()
+		return token, nil
+	}
+	s.Unlock()
+	return s.refresh(ctx)
+}
+
+// invalidate discards a token the API rejected, so the next get refreshes it.
+// It does nothing if the token has already been replaced.
+func (s *tokenSource) invalidate(token string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.token == token {
+		s.token = ""
+		s.expires = time.Time{}
+	}
+}
+
+// refresh fetches a new token. The current token is kept until the new one arrives, so a failed proactive refresh doesn't interrupt requests.
+func (s *tokenSource) refresh(ctx context.Context) (string, error) {
+	s.Lock()
+	if wait := s.refreshing; wait != nil {
+		// Share the refresh already in progress.
+		s.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		s.Lock()
+		defer s.Unlock()
+		if s.token == "" {
+			return "", fmt.Errorf("%s token refresh failed: %w", s.name, s.lastErr)
+		}
+		return s.token, nil
+	}
+	if time.Now().Before(s.retryAt) {
+		defer s.Unlock()
+		return "", fmt.Errorf("%s token refresh failed, retrying in %s: %w", s.name, time.Until(s.retryAt).Round(time.Second), s.lastErr)
+	}
+	done := make(chan struct{})
+	s.refreshing = done
+	s.Unlock()
+
+	token, expiresIn, err := s.fetch(ctx)
+
+	s.Lock()
+	defer s.Unlock()
+	s.refreshing = nil
+	close(done)
+
+	if err != nil {
+		// Cancellation is our choice, so it doesn't count towards the backoff.
+		if ctx.Err() == nil {
+			backoff := tokenRetryBackoff << s.failures
+			if backoff > tokenMaxBackoff || backoff <= 0 {
+				backoff = tokenMaxBackoff
+			}
+			s.failures++
+			s.retryAt = time.Now().Add(backoff)
+			s.lastErr = err
+		}
+		return "", err
+	}
+
+	if expiresIn <= 0 {
+		expiresIn = tokenDefaultLifetime
+	}
+	margin := tokenRefreshMargin
+	if margin > expiresIn/2 {
+		margin = expiresIn / 2
+	}
+	s.token = token
+	s.expires = time.Now().Add(expiresIn)
+	s.refreshAt = s.expires.Add(-margin)
+	s.failures = 0
+	s.retryAt = time.Time{}
+	s.lastErr = nil
+	return token, nil
+}
+
+// run refreshes the token shortly before it expires, and retries failed refreshes, until ctx is cancelled.
+func (s *tokenSource) run(ctx context.Context) error {
+	for {
+		s.Lock()
+		due := s.refreshAt
+		if s.retryAt.After(due) {
+			due = s.retryAt
+		}
+		s.Unlock()
+
+		select {
+		case <-time.After(time.Until(due)):
+		case <-ctx.Done():
+			return nil
+		}
+
+		_, err := s.refresh(ctx)
+		if err != nil && ctx.Err() == nil {
+			reportError(fmt.Sprintf("%s token refresh", s.name), err)
+		}
+	}
+}
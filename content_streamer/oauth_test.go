@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTokenServer serves a DeviantArt token endpoint that answers with respond, counting its requests.
+// respond is given the number of the request, from 1.
+func fakeTokenServer(t *testing.T, respond func(w http.ResponseWriter, n int32)) (*dAAPIClient, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" {
+			t.Errorf("got request for %s, want only token requests", r.URL.Path)
+			return
+		}
+		respond(w, atomic.AddInt32(&requests, 1))
+	}))
+	t.Cleanup(server.Close)
+	return newTestDAClient(server), &requests
+}
+
+func TestTokenSourceSharedRefresh(t *testing.T) {
+	client, requests := fakeTokenServer(t, func(w http.ResponseWriter, n int32) {
+		// Hold the response so every caller asks while the refresh is in progress.
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600}`, n)
+	})
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	errs := make([]error, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = client.tokens.get(context.Background())
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range tokens {
+		if errs[i] != nil || tokens[i] != "token1" {
+			t.Errorf("caller %d got %q, %v, want the token from the one refresh", i, tokens[i], errs[i])
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("sent %d token requests, want 1", n)
+	}
+
+	// Until it's due, the token is refreshed shortly before it expires.
+	if margin := client.tokens.expires.Sub(client.tokens.refreshAt); margin != tokenRefreshMargin {
+		t.Errorf("token is refreshed %s before it expires, want %s", margin, tokenRefreshMargin)
+	}
+	token, err := client.tokens.get(context.Background())
+	if err != nil || token != "token1" || atomic.LoadInt32(requests) != 1 {
+		t.Errorf("got %q, %v, want the current token without a request", token, err)
+	}
+}
+
+func TestTokenSourceBackoff(t *testing.T) {
+	fail := true
+	client, requests := fakeTokenServer(t, func(w http.ResponseWriter, n int32) {
+		if fail {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client","error_description":"Bad client secret."}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600}`, n)
+	})
+	s := client.tokens
+
+	_, err := s.get(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "Bad client secret") {
+		t.Fatalf("got error %v, want the token endpoint's", err)
+	}
+	if s.failures != 1 || time.Until(s.retryAt) <= 0 || time.Until(s.retryAt) > tokenRetryBackoff {
+		t.Fatalf("got %d failures, retrying in %s, want 1 retrying in %s", s.failures, time.Until(s.retryAt), tokenRetryBackoff)
+	}
+
+	// Until the backoff passes, refreshes fail without a request.
+	_, err = s.get(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "retrying in") || !strings.Contains(err.Error(), "Bad client secret") {
+		t.Errorf("got error %v, want the backoff with the last error", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("sent %d token requests during the backoff, want 1", n)
+	}
+
+	// Each failure doubles the backoff.
+	s.retryAt = time.Now()
+	s.get(context.Background())
+	if wait := time.Until(s.retryAt); s.failures != 2 || wait <= tokenRetryBackoff || wait > 2*tokenRetryBackoff {
+		t.Errorf("got %d failures, retrying in %s, want 2 retrying in %s", s.failures, wait, 2*tokenRetryBackoff)
+	}
+
+	fail = false
+	s.retryAt = time.Now()
+	token, err := s.get(context.Background())
+	if err != nil || token != "token3" {
+		t.Fatalf("got %q, %v, want the token once the endpoint recovers", token, err)
+	}
+	if s.failures != 0 || !s.retryAt.IsZero() || s.lastErr != nil {
+		t.Errorf("a successful refresh didn't reset the backoff: %d failures, retry at %s, %v", s.failures, s.retryAt, s.lastErr)
+	}
+}
+
+func TestTokenSourceKeepsTokenOnFailedRefresh(t *testing.T) {
+	fail := false
+	client, _ := fakeTokenServer(t, func(w http.ResponseWriter, n int32) {
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"server_error"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600}`, n)
+	})
+	s := client.tokens
+	s.get(context.Background())
+
+	// A proactive refresh that fails leaves the current token in use.
+	fail = true
+	if _, err := s.refresh(context.Background()); err == nil {
+		t.Fatal("refresh succeeded against a failing endpoint")
+	}
+	token, err := s.get(context.Background())
+	if err != nil || token != "token1" {
+		t.Errorf("got %q, %v, want the token from before the failed refresh", token, err)
+	}
+}
+
+func TestTokenSourceInvalidate(t *testing.T) {
+	n := 0
+	s := newTokenSource("Test", func(ctx context.Context) (string, time.Duration, error) {
+		n++
+		return fmt.Sprintf("token%d", n), time.Hour, nil
+	})
+	s.get(context.Background())
+	s.invalidate("token1")
+	token, _ := s.get(context.Background())
+	if token != "token2" {
+		t.Fatalf("got %q after invalidating the token, want a new one", token)
+	}
+
+	// A request that was sent with the old token doesn't discard its replacement.
+	s.invalidate("token1")
+	token, _ = s.get(context.Background())
+	if token != "token2" || n != 2 {
+		t.Errorf("got %q after %d refreshes, want the replacement kept", token, n)
+	}
+}
+
+func TestDAClientRefreshesInvalidToken(t *testing.T) {
+	var tokenRequests, apiRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokenRequests++
+			fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600}`, tokenRequests)
+			return
+		}
+		apiRequests++
+		if r.URL.Query().Get("access_token") != "token2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_token","error_description":"Expired oAuth2 user token."}`)
+			return
+		}
+		fmt.Fprint(w, `{"ok":true}`)
+	}))
+	defer server.Close()
+	client := newTestDAClient(server)
+
+	var result struct{ OK bool }
+	err := client.get(context.Background(), "/browse/newest", nil, &result)
+	if err != nil || !result.OK {
+		t.Fatalf("got %v, %+v, want the request retried with a new token", err, result)
+	}
+	if tokenRequests != 2 || apiRequests != 2 {
+		t.Errorf("sent %d token and %d API requests, want 2 of each", tokenRequests, apiRequests)
+	}
+}
+
+func TestDAClientInvalidTokenRetriedOnce(t *testing.T) {
+	var tokenRequests, apiRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokenRequests++
+			fmt.Fprintf(w, `{"access_token":"token%d","expires_in":3600}`, tokenRequests)
+			return
+		}
+		apiRequests++
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"invalid_token","error_description":"Expired oAuth2 user token."}`)
+	}))
+	defer server.Close()
+	client := newTestDAClient(server)
+
+	var result struct{}
+	err := client.get(context.Background(), "/browse/newest", nil, &result)
+	if err == nil || !strings.Contains(err.Error(), "invalid_token") {
+		t.Errorf("got error %v, want the API's", err)
+	}
+	if tokenRequests != 2 || apiRequests != 2 {
+		t.Errorf("sent %d token and %d API requests, want 2 of each", tokenRequests, apiRequests)
+	}
+}
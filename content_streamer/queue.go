@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+const queueCollection = "postQueue"
+
+// Stages of a post in the notification queue. A post leaves the queue once it has been notified, or if it won't be.
+const (
+	queueStageWritten    = "written"    // Saved to the database, waiting to be classified.
+	queueStageClassified = "classified" // Scored, waiting to be sent to the chat.
+	queueStageDead       = "dead"       // Classification failed too many times. Kept until replayed from the chat.
+)
+
+// queueEntry records a post's progress through the pipeline, so unfinished posts survive restarts and classifier outages.
+type queueEntry struct {
+	Key       string    `bson:"_id"` // See queueKey.
+	Site      string    `bson:"site"`
+	PostID    string    `bson:"post_id"`
+	Stage     string    `bson:"stage"`
+	Feed      string    `bson:"feed,omitempty"`       // Copied from the post's message.
+	Edit      string    `bson:"edit,omitempty"`       // Copied from the post's message.
+	SetNotify *bool     `bson:"set_notify,omitempty"` // Copied from the post's message.
+	Scored    bool      `bson:"scored"`               // Whether Score was set by the classifier.
+	Score     float64   `bson:"score"`
+	Notify    bool      `bson:"notify"`           // Whether to send the post once classified.
+	Reason    string    `bson:"reason,omitempty"` // Why the post is or isn't notified, shown in the notification.
+	Attempts  int       `bson:"attempts"`         // Number of failed classifications.
+	LastError string    `bson:"last_error,omitempty"`
+	Queued    time.Time `bson:"queued"`
+}
+
+// queueKey returns the key of a post's queue entry, which is unique by site and id.
+func queueKey(site string, id string) string {
+	return site + "/" + id
+}
+
+func newQueueEntry(message postMessage) queueEntry {
+	return queueEntry{
+		Key:       queueKey(message.post.siteName(), message.post.getID()),
+		Site:      message.post.siteName(),
+		PostID:    message.post.getID(),
+		Stage:     queueStageWritten,
+		Feed:      message.feed,
+		Edit:      message.edit,
+		SetNotify: message.setNotify,
+		Queued:    time.Now(),
+	}
+}
+
+// queuedPost pairs a queue entry with its post.
+type queuedPost struct {
+	entry queueEntry
+	post  streamablePost
+}
+
+// resumeQueue advances every queued post that isn't a dead letter, in batches.
+// This picks up posts left by a previous run, and posts held while the classifier was unavailable.
+func resumeQueue(ctx context.Context) error {
+	entries, err := db.getQueueEntries()
+	if err != nil {
+		return fmt.Errorf("failed to read the post queue: %w", err)
+	}
+
+	var batch []queuedPost
+	for _, entry := range entries {
+		if entry.Stage == queueStageDead {
+			continue
+		}
+
+		post, err := db.getPost(entry.Site, entry.PostID)
+		if errors.Is(err, errNotFound) {
+			// The post was deleted from the chat while it was queued.
+			err = db.deleteQueueEntry(entry.Key)
+			if err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to read queued post %s: %w", entry.Key, err)
+		}
+
+		batch = append(batch, queuedPost{entry: entry, post: post})
+		if len(batch) >= conf.Classifier.BatchSize {
+			err = advanceQueue(ctx, batch)
+			if err != nil || ctx.Err() != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	return advanceQueue(ctx, batch)
+}
+
+// hasPendingQueueEntries reports whether any queued posts are waiting to be classified or notified.
+func hasPendingQueueEntries() (bool, error) {
+	entries, err := db.getQueueEntries()
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.Stage != queueStageDead {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// deadLetters returns the queued posts that failed classification too many times.
+func deadLetters() ([]queueEntry, error) {
+	entries, err := db.getQueueEntries()
+	if err != nil {
+		return nil, err
+	}
+	var dead []queueEntry
+	for _, entry := range entries {
+		if entry.Stage == queueStageDead {
+			dead = append(dead, entry)
+		}
+	}
+	return dead, nil
+}
+
+// formatDeadLetters lists dead letters for the telegram chat.
+func formatDeadLetters(entries []queueEntry) string {
+	if len(entries) == 0 {
+		return "There are no dead letters."
+	}
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%d posts failed classification:\n", len(entries))
+	for _, entry := range entries {
+		fmt.Fprintf(&builder, "• %s %s - %d attempts, last error: %s\n", entry.Site, entry.PostID, entry.Attempts, entry.LastError)
+	}
+	builder.WriteString("Use /replay site post_id, or /replay all, to queue them again.")
+	return builder.String()
+}
+
+// advanceQueue moves a batch of posts through the remaining stages of the queue, saving their progress after each one.
+// Posts waiting to be classified are sent to the classifier together. If ctx is cancelled, posts are left in their current stage to be resumed later.
+func advanceQueue(ctx context.Context, batch []queuedPost) error {
+	var written, classified []queuedPost
+	for _, queued := range batch {
+		switch queued.entry.Stage {
+		case queueStageWritten:
+			written = append(written, queued)
+		case queueStageClassified:
+			classified = append(classified, queued)
+		}
+	}
+
+	// Posts decided by a rule skip the classifier.
+	var unruled []queuedPost
+	for _, queued := range written {
+		decided, err := applyRules(&queued.entry, queued.post)
+		if err != nil {
+			return err
+		}
+		if !decided {
+			unruled = append(unruled, queued)
+		} else if queued.entry.Notify {
+			classified = append(classified, queued)
+		}
+	}
+
+	newlyClassified, err := classifyQueuedPosts(ctx, unruled)
+	if err != nil {
+		return err
+	}
+	classified = append(classified, newlyClassified...)
+
+	for _, queued := range classified {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if queued.entry.Notify {
+			err := notifyQueuedPost(queued)
+			if err != nil {
+				return err
+			}
+		}
+		err := db.deleteQueueEntry(queued.entry.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyQueuedPost sends a classified post to the chat. A post that has already been sent is skipped, unless it was asked for from the chat.
+func notifyQueuedPost(queued queuedPost) error {
+	notified, err := db.postNotified(queued.entry.Site, queued.entry.PostID)
+	if errors.Is(err, errNotFound) {
+		// The post was deleted from the chat while it was queued.
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read post %s: %w", queued.entry.Key, err)
+	}
+	forced := queued.entry.SetNotify != nil && *queued.entry.SetNotify
+	if notified && !forced {
+		if debug {
+			log.Printf("Skipped repeat notification of %s\n", queued.post.formatLink())
+		}
+		return nil
+	}
+
+	score := queued.entry.Score
+	if !queued.entry.Scored {
+		score = math.NaN()
+	}
+	reason := queued.entry.Reason
+	if queued.entry.Edit != "" {
+		reason = fmt.Sprintf("%s (edited %s)", reason, queued.entry.Edit)
+	}
+	err = sendPost(queued.post, score, reason)
+	if err != nil {
+		return fmt.Errorf("failed to send post %s: %w", queued.post.getID(), err)
+	}
+	err = scheduleReminder(queued.post, score)
+	if err != nil {
+		log.Printf("Failed to schedule a reminder for post %s.\nError: %s\n", queued.entry.Key, err)
+	}
+	return db.markPostNotified(queued.entry.Site, queued.entry.PostID)
+}
+
+// classifyQueuedPosts scores written posts with one classifier request per site, and moves them to the classified stage.
+// It returns the posts that were classified.
+func classifyQueuedPosts(ctx context.Context, written []queuedPost) ([]queuedPost, error) {
+	var classified []queuedPost
+
+	for _, site := range siteTypes {
+		var sitePosts []queuedPost
+		var ids []string
+		for _, queued := range written {
+			if queued.entry.Site == site.siteName() {
+				sitePosts = append(sitePosts, queued)
+				ids = append(ids, queued.post.getID())
+			}
+		}
+		if len(sitePosts) == 0 {
+			continue
+		}
+
+		results, batchErr := classifier.classifyBatch(ctx, site.siteName(), ids)
+		if ctx.Err() != nil {
+			return classified, nil
+		}
+
+		for _, queued := range sitePosts {
+			result, found := results[queued.post.getID()]
+			err := batchErr
+			if err == nil && !found {
+				err = classifierResponseError{Type: "missing_result", Description: "The classifier didn't return a result for this post."}
+			} else if err == nil && !result.Success {
+				err = classifierResponseError{Type: result.Error, Description: result.ErrorDescription}
+			}
+
+			ok, err := applyClassification(&queued.entry, queued.post, result, err)
+			if err != nil {
+				return classified, err
+			}
+			if ok {
+				classified = append(classified, queued)
+			}
+		}
+	}
+	return classified, nil
+}
+
+// applyClassification records a post's classification and moves it to the classified stage.
+// If the classifier was unavailable, the configured fallback policy decides what happens to the post.
+// If it answered but couldn't score the post, the post is held to be retried, and moved to the dead letters once it has failed too many times.
+// Posts forced to be notified are sent without a score either way. It returns false if the post hasn't moved on.
+func applyClassification(entry *queueEntry, post streamablePost, result classificationResult, classifyErr error) (bool, error) {
+	forceNotify := entry.SetNotify != nil && *entry.SetNotify
+
+	if classifyErr == nil {
+		entry.Scored = true
+		entry.Score = result.Score
+		entry.Notify, entry.Reason = notifyDecision(entry.Site, entry.Feed, result)
+		if forceNotify && !entry.Notify {
+			entry.Notify, entry.Reason = true, "new feed or labelling request"
+		}
+	} else {
+		log.Printf("Failed to classify post %s.\nError: %s\n", post.getID(), classifyErr)
+		if !forceNotify {
+			fallback := conf.Classifier.Fallback
+			if !errors.Is(classifyErr, errClassifierUnavailable) {
+				// The classifier is up but failed on this post, e.g. because it couldn't find it, so retrying will tell if it keeps failing.
+				fallback = fallbackQueue
+			}
+			switch fallback {
+			case fallbackQueue:
+				return false, holdQueueEntry(*entry, classifyErr)
+			case fallbackDrop:
+				return false, db.deleteQueueEntry(entry.Key)
+			}
+		}
+		// Send without a score rather than silently missing the post.
+		entry.Notify = true
+		entry.Reason = "couldn't be classified"
+	}
+
+	entry.Stage = queueStageClassified
+	return true, db.putQueueEntry(*entry)
+}
+
+// applyRules checks a written post against the rules. If one matches, it decides whether the post is notified, and the post skips the classifier.
+// Posts forced to be notified aren't checked. It returns false if no rule matched.
+func applyRules(entry *queueEntry, post streamablePost) (bool, error) {
+	if entry.SetNotify != nil && *entry.SetNotify {
+		return false, nil
+	}
+	r, matched := matchRule(post)
+	if !matched {
+		return false, nil
+	}
+
+	if r.Action == ruleNever {
+		if debug {
+			log.Printf("Rule %s suppressed post %s\n", r, post.getID())
+		}
+		return true, db.deleteQueueEntry(entry.Key)
+	}
+	entry.Notify = true
+	entry.Reason = fmt.Sprintf("rule %s", r)
+	entry.Stage = queueStageClassified
+	return true, db.putQueueEntry(*entry)
+}
+
+// holdQueueEntry records a failed classification, leaving the post to be retried after the next successful health probe.
+// After too many attempts, the post is moved to the dead letters.
+func holdQueueEntry(entry queueEntry, err error) error {
+	// No request was sent, so it doesn't count as an attempt.
+	if errors.Is(err, errCircuitOpen) {
+		return nil
+	}
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+	if entry.Attempts >= conf.Classifier.MaxAttempts {
+		entry.Stage = queueStageDead
+		reportError("post notifier", fmt.Errorf("post %s failed classification %d times and was moved to the dead letters. Use /deadletters to see them.", entry.Key, entry.Attempts))
+	}
+	return db.putQueueEntry(entry)
+}
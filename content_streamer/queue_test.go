@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// roundTripFunc answers HTTP requests without a server.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// fakeTelegram points the bot at a fake Bot API for the rest of the test, and returns the text of each message it's sent.
+func fakeTelegram(t *testing.T) *[]string {
+	var sent []string
+	bot := telegramBot
+	t.Cleanup(func() { telegramBot = bot })
+	telegramBot = &tgbotapi.BotAPI{Token: "token", Client: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		err := r.ParseForm()
+		if err != nil {
+			return nil, err
+		}
+		sent = append(sent, r.PostForm.Get("text"))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(`{"ok":true,"result":{"message_id":1}}`)),
+		}, nil
+	})}}
+	return &sent
+}
+
+func TestApplyClassificationFailures(t *testing.T) {
+	postError := classifierResponseError{Type: "not_found", Description: "id not found in database"}
+	unavailable := fmt.Errorf("%w: connection refused", errClassifierUnavailable)
+
+	tests := []struct {
+		name     string
+		err      error
+		fallback string
+		forced   bool
+		moved    bool   // Whether the post moves on to be notified.
+		stage    string // Stage left in the store, or "" if the entry is deleted.
+		attempts int
+	}{
+		{"post error", postError, fallbackQueue, false, false, queueStageWritten, 1},
+		{"post error with notify fallback", postError, fallbackNotify, false, false, queueStageWritten, 1},
+		{"post error with drop fallback", postError, fallbackDrop, false, false, queueStageWritten, 1},
+		{"bad response", fmt.Errorf("%w: unexpected EOF", errBadResponse), fallbackNotify, false, false, queueStageWritten, 1},
+		{"client error", statusError{code: http.StatusBadRequest, status: "400 Bad Request"}, fallbackNotify, false, false, queueStageWritten, 1},
+		{"unavailable", unavailable, fallbackQueue, false, false, queueStageWritten, 1},
+		{"unavailable with notify fallback", unavailable, fallbackNotify, false, true, queueStageClassified, 0},
+		{"unavailable with drop fallback", unavailable, fallbackDrop, false, false, "", 0},
+		{"circuit open", errCircuitOpen, fallbackQueue, false, false, queueStageWritten, 0},
+		{"forced", postError, fallbackQueue, true, true, queueStageClassified, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf = defaultConfig()
+			conf.Classifier.Fallback = test.fallback
+			db = newMemoryStore()
+
+			post := tweet{ID: "1"}
+			entry := newQueueEntry(postMessage{post: post})
+			if test.forced {
+				entry.SetNotify = BoolPointer(true)
+			}
+			err := db.putQueueEntry(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			moved, err := applyClassification(&entry, post, classificationResult{}, test.err)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if moved != test.moved {
+				t.Errorf("got moved %v, want %v", moved, test.moved)
+			}
+			if moved && (!entry.Notify || entry.Scored) {
+				t.Errorf("got entry %+v, want it notified without a score", entry)
+			}
+
+			stored, err := db.getQueueEntry(entry.Key)
+			if test.stage == "" {
+				if !errors.Is(err, errNotFound) {
+					t.Errorf("got entry %+v, %v, want it deleted", stored, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Stage != test.stage || stored.Attempts != test.attempts {
+				t.Errorf("got stage %s after %d attempts, want %s after %d", stored.Stage, stored.Attempts, test.stage, test.attempts)
+			}
+		})
+	}
+}
+
+func TestClassificationFailuresDeadLetter(t *testing.T) {
+	conf = defaultConfig()
+	conf.Classifier.MaxAttempts = 2
+	db = newMemoryStore()
+	sent := fakeTelegram(t)
+
+	post := tweet{ID: "1"}
+	entry := newQueueEntry(postMessage{post: post})
+	postError := classifierResponseError{Type: "not_found", Description: "id not found in database"}
+	for i := 0; i < conf.Classifier.MaxAttempts; i++ {
+		// Each retry starts from the stored entry, as resumeQueue does.
+		if i > 0 {
+			var err error
+			entry, err = db.getQueueEntry(entry.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		moved, err := applyClassification(&entry, post, classificationResult{}, postError)
+		if err != nil || moved {
+			t.Fatalf("attempt %d got %v, %v, want the post held", i+1, moved, err)
+		}
+	}
+
+	dead, err := deadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Attempts != 2 || !strings.Contains(dead[0].LastError, "id not found") {
+		t.Errorf("got dead letters %+v, want the post after 2 attempts", dead)
+	}
+	if len(*sent) != 1 || !strings.Contains((*sent)[0], "dead letters") {
+		t.Errorf("sent %q, want the dead letter reported", *sent)
+	}
+}
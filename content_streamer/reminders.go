@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"time"
+)
+
+const reminderCollection = "reminders"
+
+// Time between checks for reminders that have fallen due.
+const reminderCheckInterval = time.Minute
+
+// reminder re-sends a notified post shortly before the deadline found in its text, such as the end of an auction.
+type reminder struct {
+	Key          string    `bson:"_id"` // See queueKey.
+	Site         string    `bson:"site"`
+	PostID       string    `bson:"post_id"`
+	Due          time.Time `bson:"due"`
+	Deadline     time.Time `bson:"deadline"`
+	DeadlineText string    `bson:"deadline_text"`
+	Scored       bool      `bson:"scored"` // Whether Score was set by the classifier.
+	Score        float64   `bson:"score"`
+}
+
+// reminderDue returns when a post's deadline reminder falls due, or false if it won't have one.
+func reminderDue(post streamablePost) (time.Time, *commissionDetails, bool) {
+	if conf.Telegram.ReminderBefore <= 0 {
+		return time.Time{}, nil, false
+	}
+	details := postCommission(post)
+	if details == nil || details.Deadline.IsZero() {
+		return time.Time{}, nil, false
+	}
+	due := details.Deadline.Add(-conf.Telegram.ReminderBefore)
+	// A deadline closer than the reminder would be is already in the notification.
+	if !due.After(time.Now()) {
+		return time.Time{}, nil, false
+	}
+	return due, details, true
+}
+
+// scheduleReminder saves a reminder for a post that has just been notified, if it has a deadline far enough away.
+// A post notified again, e.g. after an edit, has its reminder replaced.
+func scheduleReminder(post streamablePost, score float64) error {
+	due, details, ok := reminderDue(post)
+	if !ok {
+		return nil
+	}
+	return db.putReminder(reminder{
+		Key:          queueKey(post.siteName(), post.getID()),
+		Site:         post.siteName(),
+		PostID:       post.getID(),
+		Due:          due,
+		Deadline:     details.Deadline,
+		DeadlineText: details.DeadlineText,
+		Scored:       !math.IsNaN(score),
+		Score:        score,
+	})
+}
+
+// reminderSender sends reminders as they fall due, until ctx is cancelled.
+// Reminders are kept in the store, so any that fell due while the program was stopped are sent on starting, unless their deadline has passed.
+func reminderSender(ctx context.Context) error {
+	ticker := time.NewTicker(reminderCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		err := sendDueReminders()
+		if err != nil {
+			reportError("reminder sender", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sendDueReminders sends each reminder that has fallen due, and removes it.
+func sendDueReminders() error {
+	reminders, err := db.getReminders()
+	if err != nil {
+		return fmt.Errorf("failed to read reminders: %w", err)
+	}
+
+	now := time.Now()
+	for _, r := range reminders {
+		if r.Due.After(now) {
+			continue
+		}
+
+		if r.Deadline.After(now) {
+			post, err := db.getPost(r.Site, r.PostID)
+			if errors.Is(err, errNotFound) {
+				// The post was deleted from the chat after it was notified.
+			} else if err != nil {
+				return fmt.Errorf("failed to read post %s: %w", r.Key, err)
+			} else {
+				err = sendReminder(post, r)
+				if err != nil {
+					return fmt.Errorf("failed to send reminder for post %s: %w", r.Key, err)
+				}
+			}
+		} else {
+			log.Printf("Dropped reminder for post %s, as its deadline passed while it was waiting.\n", r.Key)
+		}
+
+		err = db.deleteReminder(r.Key)
+		if err != nil {
+			return fmt.Errorf("failed to remove reminder for post %s: %w", r.Key, err)
+		}
+	}
+	return nil
+}
+
+// sendReminder sends a post to the chat again, saying how long is left before its deadline.
+func sendReminder(post streamablePost, r reminder) error {
+	score := r.Score
+	if !r.Scored {
+		score = math.NaN()
+	}
+	left := time.Until(r.Deadline).Round(time.Minute)
+	return sendRichPost(post, fmt.Sprintf("⏰ Ends in %s (%s)\n%s", left, html.EscapeString(r.DeadlineText), formatScore(score)))
+}
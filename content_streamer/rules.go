@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ruleCollection = "rules"
+
+// Actions a rule can take on a matching post.
+const (
+	ruleAlways = "always" // Notify the post without classifying it.
+	ruleNever  = "never"  // Don't notify the post.
+)
+
+// Fields of a post a rule can match.
+const (
+	ruleFieldAuthor = "author" // Pattern is a username. Case insensitive.
+	ruleFieldTag    = "tag"    // Pattern is a tag. Case insensitive.
+	ruleFieldText   = "text"   // Pattern is a regular expression, matched against the title, description or body. Case insensitive.
+	ruleFieldMature = "mature" // Matches mature posts. Has no pattern.
+)
+
+// postFields are the parts of a post that rules match against.
+type postFields struct {
+	Author string
+	Tags   []string
+	Text   []string // Title, description or body, depending on the site.
+	Mature bool
+}
+
+// rule is a user-defined filter, checked before a post is classified.
+// A matching rule decides alone whether the post is notified, and the post isn't classified, so rules can't act on scores.
+// If both never and always rules match a post, the never rule wins.
+type rule struct {
+	ID      int    `bson:"_id"`
+	Action  string `bson:"action"`
+	Field   string `bson:"field"`
+	Pattern string `bson:"pattern,omitempty"`
+}
+
+// ruleKey returns the key of a rule in a key-value store.
+func ruleKey(id int) string {
+	return strconv.Itoa(id)
+}
+
+func (r rule) String() string {
+	if r.Field == ruleFieldMature {
+		return fmt.Sprintf("#%d %s notify mature posts", r.ID, r.Action)
+	}
+	return fmt.Sprintf("#%d %s notify %s %s", r.ID, r.Action, r.Field, r.Pattern)
+}
+
+// compileRule checks a rule, returning the compiled pattern for text rules.
+func compileRule(r rule) (*regexp.Regexp, error) {
+	if r.Action != ruleAlways && r.Action != ruleNever {
+		return nil, fmt.Errorf("action must be %s or %s", ruleAlways, ruleNever)
+	}
+	switch r.Field {
+	case ruleFieldAuthor, ruleFieldTag:
+		if r.Pattern == "" {
+			return nil, fmt.Errorf("%s rules need a pattern", r.Field)
+		}
+		return nil, nil
+	case ruleFieldText:
+		return regexp.Compile("(?i)" + r.Pattern)
+	case ruleFieldMature:
+		if r.Pattern != "" {
+			return nil, errors.New("mature rules don't take a pattern")
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("field must be one of %s, %s, %s or %s", ruleFieldAuthor, ruleFieldTag, ruleFieldText, ruleFieldMature)
+	}
+}
+
+// matches reports whether a rule matches a post's fields. pattern is the compiled pattern of a text rule.
+func (r rule) matches(fields postFields, pattern *regexp.Regexp) bool {
+	switch r.Field {
+	case ruleFieldAuthor:
+		return strings.EqualFold(fields.Author, r.Pattern)
+	case ruleFieldTag:
+		for _, tag := range fields.Tags {
+			if strings.EqualFold(tag, r.Pattern) {
+				return true
+			}
+		}
+	case ruleFieldText:
+		for _, text := range fields.Text {
+			if pattern.MatchString(text) {
+				return true
+			}
+		}
+	case ruleFieldMature:
+		return fields.Mature
+	}
+	return false
+}
+
+// Rules cached from the store, in id order.
+var rules struct {
+	sync.RWMutex
+	list     []rule
+	patterns map[int]*regexp.Regexp // Compiled patterns of text rules, by id.
+}
+
+// loadRules reads the rules saved in the store into the cache.
+func loadRules() error {
+	saved, err := db.getRules()
+	if err != nil {
+		return err
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].ID < saved[j].ID
+	})
+
+	patterns := make(map[int]*regexp.Regexp)
+	for _, r := range saved {
+		pattern, err := compileRule(r)
+		if err != nil {
+			return fmt.Errorf("invalid rule %s: %w", r, err)
+		}
+		patterns[r.ID] = pattern
+	}
+
+	rules.Lock()
+	defer rules.Unlock()
+	rules.list = saved
+	rules.patterns = patterns
+	return nil
+}
+
+// matchRule returns the rule deciding whether a post is notified, if any.
+// Never rules take precedence over always rules, so a post is only let through if nothing excludes it.
+func matchRule(post streamablePost) (rule, bool) {
+	fields := post.filterFields()
+
+	rules.RLock()
+	defer rules.RUnlock()
+
+	var always *rule
+	for i, r := range rules.list {
+		if !r.matches(fields, rules.patterns[r.ID]) {
+			continue
+		}
+		if r.Action == ruleNever {
+			return r, true
+		}
+		if always == nil {
+			always = &rules.list[i]
+		}
+	}
+	if always != nil {
+		return *always, true
+	}
+	return rule{}, false
+}
+
+// addRule validates a rule, gives it the next free id, and saves it to the store and the cache.
+func addRule(r rule) (rule, error) {
+	pattern, err := compileRule(r)
+	if err != nil {
+		return r, err
+	}
+
+	rules.Lock()
+	defer rules.Unlock()
+
+	r.ID = 1
+	if len(rules.list) > 0 {
+		r.ID = rules.list[len(rules.list)-1].ID + 1
+	}
+	err = db.putRule(r)
+	if err != nil {
+		return r, err
+	}
+	rules.list = append(rules.list, r)
+	rules.patterns[r.ID] = pattern
+	return r, nil
+}
+
+// removeRule deletes a rule from the store and the cache.
+func removeRule(id int) error {
+	rules.Lock()
+	defer rules.Unlock()
+
+	for i, r := range rules.list {
+		if r.ID != id {
+			continue
+		}
+		err := db.deleteRule(id)
+		if err != nil {
+			return err
+		}
+		rules.list = append(rules.list[:i], rules.list[i+1:]...)
+		delete(rules.patterns, id)
+		return nil
+	}
+	return errNotFound
+}
+
+// formatRules lists every rule for the telegram chat.
+func formatRules() string {
+	rules.RLock()
+	defer rules.RUnlock()
+
+	if len(rules.list) == 0 {
+		return "There are no rules. Use /rule add to create one."
+	}
+	var builder strings.Builder
+	for _, r := range rules.list {
+		fmt.Fprintf(&builder, "%s\n", r)
+	}
+	builder.WriteString("\nRules are checked before classification, and a post matching one isn't scored. Never rules win over always rules.")
+	return builder.String()
+}
+
+// ruleCommand handles the arguments of the /rule command, returning the reply.
+// The forms are "add action field [pattern]", "list" and "rm id".
+func ruleCommand(arguments []string) string {
+	if len(arguments) == 0 {
+		return "Sorry, I don't know how to parse those parameters. Check /help for usage."
+	}
+
+	switch arguments[0] {
+	case "list":
+		return formatRules()
+
+	case "add":
+		if len(arguments) < 3 {
+			return "Sorry, I need an action and a field, e.g. /rule add never tag ych."
+		}
+		r := rule{
+			Action:  arguments[1],
+			Field:   arguments[2],
+			Pattern: strings.Join(arguments[3:], " "),
+		}
+		r, err := addRule(r)
+		if err != nil {
+			return fmt.Sprintf("Sorry, I couldn't add that rule.\nError: %s", err)
+		}
+		return fmt.Sprintf("Added rule %s.", r)
+
+	case "rm":
+		if len(arguments) != 2 {
+			return "Sorry, I need the id of the rule to remove. Check /rule list for ids."
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(arguments[1], "#"))
+		if err != nil {
+			return "Sorry, the rule id must be a number."
+		}
+		err = removeRule(id)
+		if errors.Is(err, errNotFound) {
+			return fmt.Sprintf("Sorry, there's no rule #%d.", id)
+		} else if err != nil {
+			return fmt.Sprintf("Sorry, I couldn't remove that rule.\nError: %s", err)
+		}
+		return fmt.Sprintf("Removed rule #%d.", id)
+
+	default:
+		return "Sorry, I don't recognise that. Use /rule add, /rule list or /rule rm."
+	}
+}
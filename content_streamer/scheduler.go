@@ -0,0 +1,229 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// scheduledFeed is a DeviantArt feed known to the scheduler.
+type scheduledFeed struct {
+	feed    dAFeed
+	due     time.Time // When the feed should next be polled.
+	index   int       // Position in the queue, or -1 while it's being polled or paused.
+	polling bool      // Handed out to a worker and not yet returned.
+	paused  bool
+	removed bool // Unfollowed while being polled, so it's dropped when it's returned.
+}
+
+// scheduleQueue is a min-heap of feeds ordered by due time.
+type scheduleQueue []*scheduledFeed
+
+func (q scheduleQueue) Len() int           { return len(q) }
+func (q scheduleQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *scheduleQueue) Push(x interface{}) {
+	s := x.(*scheduledFeed)
+	s.index = len(*q)
+	*q = append(*q, s)
+}
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	s := old[len(old)-1]
+	old[len(old)-1] = nil
+	s.index = -1
+	*q = old[:len(old)-1]
+	return s
+}
+
+// feedScheduler hands DeviantArt feeds to the download workers in order of when they're next due.
+// Feeds can be added, removed, paused and resumed while the workers are running.
+type feedScheduler struct {
+	sync.Mutex
+	queue   scheduleQueue
+	feeds   map[string]*scheduledFeed // Every feed, by dAFeedKey, including those being polled or paused.
+	changed chan struct{}             // Closed and replaced whenever the queue changes, to wake waiting workers.
+}
+
+func newFeedScheduler() *feedScheduler {
+	return &feedScheduler{
+		feeds:   make(map[string]*scheduledFeed),
+		changed: make(chan struct{}),
+	}
+}
+
+// Global scheduler for the DeviantArt workers.
+var dASchedule = newFeedScheduler()
+
+// withJitter randomly lengthens or shortens an interval by up to the configured fraction, so feeds added together drift apart.
+func withJitter(interval time.Duration) time.Duration {
+	if conf.Polling.Jitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration((rand.Float64()*2-1)*conf.Polling.Jitter*float64(interval))
+}
+
+// notify wakes any workers waiting for the queue to change. Must be called with the lock held.
+func (s *feedScheduler) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// add schedules a feed to be polled at due. A feed that's already scheduled is updated instead.
+func (s *feedScheduler) add(feed dAFeed, due time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := dAFeedKey(feed)
+	scheduled, ok := s.feeds[key]
+	if ok && scheduled.polling {
+		// Followed again while a worker is still polling the old copy, so keep it when it's returned.
+		scheduled.removed = false
+		scheduled.paused = feed.Paused
+		return
+	}
+	if ok && scheduled.index >= 0 {
+		heap.Remove(&s.queue, scheduled.index)
+	}
+
+	scheduled = &scheduledFeed{feed: feed, due: due, index: -1, paused: feed.Paused}
+	s.feeds[key] = scheduled
+	if !scheduled.paused {
+		heap.Push(&s.queue, scheduled)
+		s.notify()
+	}
+}
+
+// remove stops polling a feed. A feed that's being polled is dropped when its worker returns it.
+func (s *feedScheduler) remove(key string) {
+	s.Lock()
+	defer s.Unlock()
+
+	scheduled, ok := s.feeds[key]
+	if !ok {
+		return
+	}
+	if scheduled.polling {
+		scheduled.removed = true
+		return
+	}
+	if scheduled.index >= 0 {
+		heap.Remove(&s.queue, scheduled.index)
+	}
+	delete(s.feeds, key)
+}
+
+// setPaused pauses or resumes a feed. A resumed feed is polled straight away.
+func (s *feedScheduler) setPaused(key string, paused bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	scheduled, ok := s.feeds[key]
+	if !ok || scheduled.paused == paused {
+		return
+	}
+	scheduled.paused = paused
+	scheduled.feed.Paused = paused
+	if scheduled.polling {
+		return
+	}
+	if paused {
+		heap.Remove(&s.queue, scheduled.index)
+		return
+	}
+	scheduled.due = time.Now()
+	heap.Push(&s.queue, scheduled)
+	s.notify()
+}
+
+// update changes a feed's settings from the chat. If the change makes the feed due sooner, it's rescheduled.
+func (s *feedScheduler) update(key string, change func(feed *dAFeed)) {
+	s.Lock()
+	defer s.Unlock()
+
+	scheduled, ok := s.feeds[key]
+	if !ok {
+		return
+	}
+	change(&scheduled.feed)
+	if scheduled.index < 0 {
+		return
+	}
+	due := scheduled.feed.LastQueryTime.Add(dAPollInterval(scheduled.feed))
+	if due.Before(scheduled.due) {
+		scheduled.due = due
+		heap.Fix(&s.queue, scheduled.index)
+		s.notify()
+	}
+}
+
+// next waits until a feed is due and hands it to the caller, who must pass it back to done once it's polled.
+// It returns false if ctx is cancelled first.
+func (s *feedScheduler) next(ctx context.Context) (dAFeed, bool) {
+	for {
+		s.Lock()
+		changed := s.changed
+		var timer *time.Timer
+		var wait <-chan time.Time
+		if len(s.queue) > 0 {
+			first := s.queue[0]
+			delay := time.Until(first.due)
+			if delay <= 0 {
+				heap.Pop(&s.queue)
+				first.polling = true
+				s.Unlock()
+				return first.feed, true
+			}
+			timer = time.NewTimer(delay)
+			wait = timer.C
+		}
+		s.Unlock()
+
+		select {
+		case <-wait:
+		case <-changed:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return dAFeed{}, false
+		}
+	}
+}
+
+// done returns a polled feed to the scheduler, to be polled again after its interval.
+func (s *feedScheduler) done(feed dAFeed) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := dAFeedKey(feed)
+	scheduled, ok := s.feeds[key]
+	if !ok {
+		return
+	}
+	scheduled.polling = false
+	if scheduled.removed {
+		delete(s.feeds, key)
+		return
+	}
+
+	// Keep changes made from the chat while the feed was being polled.
+	feed.Paused = scheduled.paused
+	feed.Hot = scheduled.feed.Hot
+	feed.Positives = scheduled.feed.Positives
+	scheduled.feed = feed
+	scheduled.due = time.Now().Add(withJitter(dAPollInterval(feed)))
+	if scheduled.paused {
+		return
+	}
+	heap.Push(&s.queue, scheduled)
+	s.notify()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestScheduler returns an empty scheduler, with every feed polled at a fixed one hour delay and no jitter.
+func newTestScheduler() *feedScheduler {
+	conf = defaultConfig()
+	conf.Polling.Adaptive = false
+	conf.Polling.Delay = time.Hour
+	conf.Polling.MinDelay = time.Minute
+	conf.Polling.Jitter = 0
+	return newFeedScheduler()
+}
+
+// nextWithin returns the next feed due within wait, or false if none is.
+func nextWithin(s *feedScheduler, wait time.Duration) (dAFeed, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	return s.next(ctx)
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := newTestScheduler()
+	now := time.Now()
+	s.add(dAFeed{FeedType: "tag", Query: "a"}, now.Add(-time.Minute))
+	s.add(dAFeed{FeedType: "tag", Query: "b"}, now.Add(-3*time.Minute))
+	s.add(dAFeed{FeedType: "tag", Query: "c"}, now.Add(-2*time.Minute))
+	s.add(dAFeed{FeedType: "tag", Query: "later"}, now.Add(time.Hour))
+
+	for _, want := range []string{"b", "c", "a"} {
+		feed, ok := nextWithin(s, time.Second)
+		if !ok || feed.Query != want {
+			t.Fatalf("got feed %q, %v, want %q", feed.Query, ok, want)
+		}
+	}
+	if feed, ok := nextWithin(s, 20*time.Millisecond); ok {
+		t.Errorf("got feed %q before it was due", feed.Query)
+	}
+}
+
+func TestSchedulerAddReplaces(t *testing.T) {
+	s := newTestScheduler()
+	s.add(dAFeed{FeedType: "tag", Query: "a"}, time.Now().Add(time.Hour))
+	s.add(dAFeed{FeedType: "tag", Query: "a"}, time.Now())
+
+	if _, ok := nextWithin(s, time.Second); !ok {
+		t.Fatal("re-adding a feed didn't reschedule it")
+	}
+	if _, ok := nextWithin(s, 20*time.Millisecond); ok {
+		t.Error("re-adding a feed scheduled it twice")
+	}
+}
+
+func TestSchedulerRemoveWhileWaiting(t *testing.T) {
+	s := newTestScheduler()
+	s.add(dAFeed{FeedType: "tag", Query: "a"}, time.Now().Add(50*time.Millisecond))
+
+	got := make(chan dAFeed)
+	go func() {
+		feed, _ := nextWithin(s, 200*time.Millisecond)
+		got <- feed
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.remove("tag/a")
+
+	if feed := <-got; feed.Query != "" {
+		t.Errorf("got feed %q after it was removed", feed.Query)
+	}
+}
+
+func TestSchedulerWakesOnAdd(t *testing.T) {
+	s := newTestScheduler()
+	s.add(dAFeed{FeedType: "tag", Query: "later"}, time.Now().Add(time.Hour))
+
+	got := make(chan dAFeed)
+	go func() {
+		feed, _ := nextWithin(s, time.Second)
+		got <- feed
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.add(dAFeed{FeedType: "tag", Query: "now"}, time.Now())
+
+	if feed := <-got; feed.Query != "now" {
+		t.Errorf("got feed %q, want the feed added while waiting", feed.Query)
+	}
+}
+
+func TestSchedulerRemoveWhilePolling(t *testing.T) {
+	s := newTestScheduler()
+	s.add(dAFeed{FeedType: "tag", Query: "a"}, time.Now())
+
+	feed, ok := nextWithin(s, time.Second)
+	if !ok {
+		t.Fatal("feed wasn't handed out")
+	}
+	s.remove("tag/a")
+	s.done(feed)
+
+	if _, ok := s.feeds["tag/a"]; ok {
+		t.Error("feed removed while polling was kept once returned")
+	}
+	if len(s.queue) != 0 {
+		t.Error("feed removed while polling was rescheduled")
+	}
+}
+
+func TestSchedulerRefollowWhilePolling(t *testing.T) {
+	s := newTestScheduler()
+	s.add(dAFeed{FeedType: "tag", Query: "a"}, time.Now())
+
+	feed, _ := nextWithin(s, time.Second)
+	s.remove("tag/a")
+	s.add(dAFeed{FeedType: "tag", Query: "a"}, time.Now())
+	s.done(feed)
+
+	if len(s.queue) != 1 {
+		t.Error("feed followed again while polling wasn't rescheduled")
+	}
+}
+
+func TestSchedulerPauseResume(t *testing.T) {
+	s := newTestScheduler()
+	s.add(dAFeed{FeedType: "tag", Query: "a"}, time.Now().Add(time.Hour))
+	s.add(dAFeed{FeedType: "tag", Query: "paused", Paused: true}, time.Now())
+
+	if feed, ok := nextWithin(s, 20*time.Millisecond); ok {
+		t.Fatalf("got feed %q, want paused feeds skipped", feed.Query)
+	}
+
+	// A resumed feed is polled straight away, however long it was due to wait.
+	s.setPaused("tag/a", true)
+	s.setPaused("tag/a", false)
+	feed, ok := nextWithin(s, time.Second)
+	if !ok || feed.Query != "a" || feed.Paused {
+		t.Fatalf("got feed %+v, %v, want the resumed feed", feed, ok)
+	}
+
+	// A feed paused while polling isn't rescheduled when it's returned.
+	s.setPaused("tag/a", true)
+	s.done(feed)
+	if len(s.queue) != 0 {
+		t.Error("feed paused while polling was rescheduled")
+	}
+	if !s.feeds["tag/a"].feed.Paused {
+		t.Error("returning a feed lost its pause")
+	}
+
+	s.setPaused("tag/paused", false)
+	feed, ok = nextWithin(s, time.Second)
+	if !ok || feed.Query != "paused" {
+		t.Errorf("got feed %q, %v, want the feed that started paused", feed.Query, ok)
+	}
+}
+
+func TestSchedulerDone(t *testing.T) {
+	s := newTestScheduler()
+	s.add(dAFeed{FeedType: "tag", Query: "a"}, time.Now())
+	s.add(dAFeed{FeedType: "tag", Query: "b", Hot: true}, time.Now())
+
+	for i := 0; i < 2; i++ {
+		feed, ok := nextWithin(s, time.Second)
+		if !ok {
+			t.Fatal("feed wasn't handed out")
+		}
+		s.done(feed)
+	}
+	if len(s.queue) != 2 {
+		t.Fatalf("got %d feeds queued, want both polled feeds rescheduled", len(s.queue))
+	}
+	// Hot feeds are polled again after the minimum delay, and others after the configured delay.
+	if due := time.Until(s.feeds["tag/a"].due); due <= 59*time.Minute || due > time.Hour {
+		t.Errorf("feed is due in %s, want an hour", due)
+	}
+	if due := time.Until(s.feeds["tag/b"].due); due <= 59*time.Second || due > time.Minute {
+		t.Errorf("hot feed is due in %s, want a minute", due)
+	}
+}
+
+func TestSchedulerUpdate(t *testing.T) {
+	s := newTestScheduler()
+	feed := dAFeed{FeedType: "tag", Query: "a", LastQueryTime: time.Now().Add(-10 * time.Minute)}
+	s.add(feed, feed.LastQueryTime.Add(dAPollInterval(feed)))
+
+	if _, ok := nextWithin(s, 20*time.Millisecond); ok {
+		t.Fatal("feed polled before its delay")
+	}
+
+	// Making the feed hot brings it forward to the minimum delay after its last poll, which has passed.
+	s.update("tag/a", func(f *dAFeed) { f.Hot = true })
+	polled, ok := nextWithin(s, time.Second)
+	if !ok || !polled.Hot {
+		t.Fatalf("got feed %+v, %v, want the hot feed due straight away", polled, ok)
+	}
+
+	// Changes made while a feed is polled are kept when it's returned.
+	s.update("tag/a", func(f *dAFeed) { f.Positives = []int64{1} })
+	polled.Hot = false
+	polled.LastQueryTime = time.Now()
+	s.done(polled)
+	scheduled := s.feeds["tag/a"]
+	if !scheduled.feed.Hot || len(scheduled.feed.Positives) != 1 {
+		t.Errorf("got feed %+v, want changes from the chat kept", scheduled.feed)
+	}
+	if due := time.Until(scheduled.due); due <= 0 || due > conf.Polling.MinDelay {
+		t.Errorf("returned hot feed is due in %s, want the minimum delay", due)
+	}
+
+	// Updates that would make a feed due later don't postpone it.
+	s.update("tag/a", func(f *dAFeed) { f.Hot = false })
+	if due := time.Until(scheduled.due); due > conf.Polling.MinDelay {
+		t.Errorf("cooling a feed postponed it to %s", due)
+	}
+}
+
+func TestWithJitter(t *testing.T) {
+	conf = defaultConfig()
+	conf.Polling.Jitter = 0
+	if withJitter(time.Hour) != time.Hour {
+		t.Error("jitter applied when turned off")
+	}
+
+	conf.Polling.Jitter = 0.1
+	varied := false
+	for i := 0; i < 1000; i++ {
+		got := withJitter(time.Hour)
+		if got < 54*time.Minute || got > 66*time.Minute {
+			t.Fatalf("jittered interval %s is outside 10%% of an hour", got)
+		}
+		varied = varied || got != time.Hour
+	}
+	if !varied {
+		t.Error("jitter never changed the interval")
+	}
+}
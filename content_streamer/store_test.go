@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storeBackends opens an empty store of each backend for a test. MongoDB is included if WAGYL_TEST_MONGO_URI is set.
+var storeBackends = map[string]func(t *testing.T) store{
+	"memory": func(t *testing.T) store {
+		return newMemoryStore()
+	},
+	"bolt": func(t *testing.T) store {
+		s, err := newBoltStore(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	},
+	"mongo": func(t *testing.T) store {
+		uri := os.Getenv(envPrefix + "TEST_MONGO_URI")
+		if uri == "" {
+			t.Skip(envPrefix + "TEST_MONGO_URI is not set")
+		}
+		s, err := newMongoStore(uri, fmt.Sprintf("wagyl-test-%d", time.Now().UnixNano()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			s.database.Drop(context.Background())
+		})
+		return s
+	},
+}
+
+// testStores runs a test against every backend.
+func testStores(t *testing.T, test func(t *testing.T, s store)) {
+	for name, open := range storeBackends {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			t.Cleanup(func() { s.close() })
+			test(t, s)
+		})
+	}
+}
+
+func TestStoreInsertPost(t *testing.T) {
+	testStores(t, func(t *testing.T, s store) {
+		post := deviation{Deviationid: "d1", Title: "YCH", PublishedTime: 100}
+
+		inserted, err := s.insertPost(post, "tag/ych")
+		if err != nil || !inserted {
+			t.Fatalf("first insert returned %v, %v, want true", inserted, err)
+		}
+		// A second download, even from another feed, doesn't replace the post.
+		changed := post
+		changed.Title = "Changed"
+		inserted, err = s.insertPost(changed, "user/someone")
+		if err != nil || inserted {
+			t.Fatalf("second insert returned %v, %v, want false", inserted, err)
+		}
+		inserted, err = s.insertPost(post, "tag/ych")
+		if err != nil || inserted {
+			t.Fatalf("repeated insert returned %v, %v, want false", inserted, err)
+		}
+
+		stored, err := s.getPost("deviantart", "d1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.(deviation).Title != "YCH" {
+			t.Errorf("stored title is %q, want the first download's", stored.(deviation).Title)
+		}
+
+		notified, err := s.postNotified("deviantart", "d1")
+		if err != nil || notified {
+			t.Errorf("new post notified is %v, %v, want false", notified, err)
+		}
+		err = s.markPostNotified("deviantart", "d1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		notified, err = s.postNotified("deviantart", "d1")
+		if err != nil || !notified {
+			t.Errorf("marked post notified is %v, %v, want true", notified, err)
+		}
+
+		err = s.deletePost("deviantart", "d1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.getPost("deviantart", "d1")
+		if !errors.Is(err, errNotFound) {
+			t.Errorf("deleted post returned %v, want errNotFound", err)
+		}
+	})
+}
+
+// Updating a document that doesn't exist fails the same way in every backend, e.g. after a feed is unfollowed mid-poll.
+func TestStoreUpdateMissing(t *testing.T) {
+	testStores(t, func(t *testing.T, s store) {
+		feed := dAFeed{FeedType: "tag", Query: "missing"}
+		updates := map[string]func() error{
+			"markPostNotified":     func() error { return s.markPostNotified("deviantart", "missing") },
+			"updatePostNotify":     func() error { return s.updatePostNotify("deviantart", "missing", true) },
+			"addDeviationRevision": func() error { return s.addDeviationRevision(deviation{Deviationid: "missing"}, dARevision{}) },
+			"updateDAFeed":         func() error { return s.updateDAFeed(feed) },
+			"setDAFeedPaused":      func() error { return s.setDAFeedPaused(feed, true) },
+			"setDAFeedHot":         func() error { return s.setDAFeedHot(feed, true) },
+			"addDAFeedPositive":    func() error { return s.addDAFeedPositive(feed, 1) },
+			"updateTwitterFeed":    func() error { return s.updateTwitterFeed(twitterFeed{Username: "missing"}) },
+			"setTwitterFeedPaused": func() error { return s.setTwitterFeedPaused("missing", true) },
+		}
+		for name, update := range updates {
+			if err := update(); !errors.Is(err, errNotFound) {
+				t.Errorf("%s of a missing document returned %v, want errNotFound", name, err)
+			}
+		}
+		if _, err := s.postNotified("deviantart", "missing"); !errors.Is(err, errNotFound) {
+			t.Errorf("postNotified of a missing post returned %v, want errNotFound", err)
+		}
+
+		// Nothing is created by a failed update.
+		feeds, err := s.getDAFeeds()
+		if err != nil || len(feeds) != 0 {
+			t.Errorf("got feeds %v, %v, want none", feeds, err)
+		}
+	})
+}
+
+func TestStoreDeviations(t *testing.T) {
+	testStores(t, func(t *testing.T, s store) {
+		for i, published := range []int64{100, 200, 300} {
+			_, err := s.insertPost(deviation{Deviationid: fmt.Sprint("d", i), Title: "Old", PublishedTime: published}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		recent, err := s.getRecentDeviations(200)
+		if err != nil || len(recent) != 2 {
+			t.Fatalf("got %d recent deviations, %v, want 2", len(recent), err)
+		}
+
+		err = s.markPostNotified("deviantart", "d2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < revisionHistory+2; i++ {
+			err = s.addDeviationRevision(deviation{Deviationid: "d2", Title: fmt.Sprint("New ", i)}, dARevision{Title: fmt.Sprint("Old ", i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		stored, err := s.getPost("deviantart", "d2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := stored.(deviation)
+		if d.Title != fmt.Sprint("New ", revisionHistory+1) {
+			t.Errorf("title is %q, want the latest revision's", d.Title)
+		}
+		if len(d.Revisions) != revisionHistory || d.Revisions[0].Title != "Old 2" {
+			t.Errorf("kept %d revisions starting %+v, want the newest %d", len(d.Revisions), d.Revisions[0], revisionHistory)
+		}
+		notified, err := s.postNotified("deviantart", "d2")
+		if err != nil || notified {
+			t.Errorf("edited post notified is %v, %v, want it cleared", notified, err)
+		}
+	})
+}
+
+func TestStoreFollowTwice(t *testing.T) {
+	testStores(t, func(t *testing.T, s store) {
+		feed := dAFeed{FeedType: "tag", Query: "ych"}
+		for i := 0; i < 2; i++ {
+			err := s.insertDAFeed(feed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.insertTwitterFeed(twitterFeed{Username: "someone"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		dAFeeds, err := s.getDAFeeds()
+		if err != nil || len(dAFeeds) != 1 {
+			t.Errorf("got DeviantArt feeds %+v, %v, want one after following twice", dAFeeds, err)
+		}
+		twitterFeeds, err := s.getTwitterFeeds()
+		if err != nil || len(twitterFeeds) != 1 {
+			t.Errorf("got twitter feeds %+v, %v, want one after following twice", twitterFeeds, err)
+		}
+
+		err = s.deleteDAFeed(feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.deleteTwitterFeed("someone")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dAFeeds, _ = s.getDAFeeds()
+		twitterFeeds, _ = s.getTwitterFeeds()
+		if len(dAFeeds) != 0 || len(twitterFeeds) != 0 {
+			t.Errorf("got feeds %+v and %+v after unfollowing once, want none", dAFeeds, twitterFeeds)
+		}
+	})
+}
+
+func TestStoreFeeds(t *testing.T) {
+	testStores(t, func(t *testing.T, s store) {
+		feed := dAFeed{FeedType: "tag", Query: "ych", NewFeed: true}
+		err := s.insertDAFeed(feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.insertDAFeed(dAFeed{FeedType: "user", Query: "someone"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		feed.LastPostTime = 500
+		feed.NewFeed = false
+		feed.PostCount = 3
+		feed.RecentPostTimes = []int64{400, 500}
+		for _, update := range []error{
+			s.updateDAFeed(feed),
+			s.setDAFeedPaused(feed, true),
+			s.setDAFeedHot(feed, true),
+			s.addDAFeedPositive(feed, 450),
+		} {
+			if update != nil {
+				t.Fatal(update)
+			}
+		}
+
+		feeds, err := s.getDAFeeds()
+		if err != nil || len(feeds) != 2 {
+			t.Fatalf("got %d feeds, %v, want 2", len(feeds), err)
+		}
+		for _, got := range feeds {
+			if got.FeedType != "tag" {
+				if got.Paused || got.Hot || got.PostCount != 0 {
+					t.Errorf("updating one feed changed another: %+v", got)
+				}
+				continue
+			}
+			if got.LastPostTime != 500 || got.NewFeed || got.PostCount != 3 || len(got.RecentPostTimes) != 2 || !got.Paused || !got.Hot || len(got.Positives) != 1 {
+				t.Errorf("got feed %+v, want every update applied", got)
+			}
+		}
+
+		err = s.deleteDAFeed(feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		feeds, err = s.getDAFeeds()
+		if err != nil || len(feeds) != 1 {
+			t.Errorf("got %d feeds after deleting one, %v, want 1", len(feeds), err)
+		}
+
+		err = s.insertTwitterFeed(twitterFeed{Username: "someone"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.updateTwitterFeed(twitterFeed{Username: "someone", UserID: "42", LastPostTime: 100, PostCount: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.setTwitterFeedPaused("someone", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twitterFeeds, err := s.getTwitterFeeds()
+		if err != nil || len(twitterFeeds) != 1 {
+			t.Fatalf("got %d twitter feeds, %v, want 1", len(twitterFeeds), err)
+		}
+		if got := twitterFeeds[0]; got.UserID != "42" || got.LastPostTime != 100 || got.PostCount != 2 || !got.Paused {
+			t.Errorf("got twitter feed %+v, want every update applied", got)
+		}
+		err = s.deleteTwitterFeed("someone")
+		if err != nil {
+			t.Fatal(err)
+		}
+		twitterFeeds, err = s.getTwitterFeeds()
+		if err != nil || len(twitterFeeds) != 0 {
+			t.Errorf("got %d twitter feeds after deleting, %v, want 0", len(twitterFeeds), err)
+		}
+	})
+}
+
+func TestStoreQueue(t *testing.T) {
+	testStores(t, func(t *testing.T, s store) {
+		start := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+		// Keys are out of order with the queued times, which set the order entries are resumed in.
+		entries := []queueEntry{
+			{Key: queueKey("twitter", "1"), Site: "twitter", PostID: "1", Stage: queueStageWritten, Queued: start.Add(2 * time.Minute)},
+			{Key: queueKey("deviantart", "b"), Site: "deviantart", PostID: "b", Stage: queueStageWritten, Queued: start},
+			{Key: queueKey("deviantart", "a"), Site: "deviantart", PostID: "a", Stage: queueStageWritten, Queued: start.Add(time.Minute)},
+		}
+		for _, entry := range entries {
+			err := s.putQueueEntry(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Move one entry through the stages.
+		entry := entries[2]
+		entry.Stage = queueStageClassified
+		entry.Scored = true
+		entry.Score = 0.5
+		entry.Notify = true
+		err := s.putQueueEntry(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.getQueueEntry(entry.Key)
+		if err != nil || got.Stage != queueStageClassified || got.Score != 0.5 || !got.Notify {
+			t.Errorf("got entry %+v, %v, want it classified", got, err)
+		}
+		dead := entries[0]
+		dead.Stage = queueStageDead
+		dead.Attempts = 5
+		dead.LastError = "classifier unavailable"
+		err = s.putQueueEntry(dead)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		all, err := s.getQueueEntries()
+		if err != nil || len(all) != 3 {
+			t.Fatalf("got %d entries, %v, want 3", len(all), err)
+		}
+		var order []string
+		for _, e := range all {
+			order = append(order, e.Key+":"+e.Stage)
+		}
+		want := []string{"deviantart/b:written", "deviantart/a:classified", "twitter/1:dead"}
+		if fmt.Sprint(order) != fmt.Sprint(want) {
+			t.Errorf("got entries %v, want %v", order, want)
+		}
+
+		err = s.deleteQueueEntry(entry.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.getQueueEntry(entry.Key)
+		if !errors.Is(err, errNotFound) {
+			t.Errorf("deleted entry returned %v, want errNotFound", err)
+		}
+	})
+}
+
+func TestStoreSettings(t *testing.T) {
+	testStores(t, func(t *testing.T, s store) {
+		err := s.putThreshold(threshold{Key: "twitter", Site: "twitter", Value: 0.5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.putThreshold(threshold{Key: "twitter", Site: "twitter", Value: 0.7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		thresholds, err := s.getThresholds()
+		if err != nil || len(thresholds) != 1 || thresholds[0].Value != 0.7 {
+			t.Errorf("got thresholds %+v, %v, want the replacement", thresholds, err)
+		}
+		err = s.deleteThreshold("twitter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		thresholds, err = s.getThresholds()
+		if err != nil || len(thresholds) != 0 {
+			t.Errorf("got thresholds %+v, %v, want none", thresholds, err)
+		}
+
+		err = s.putReminder(reminder{Key: "deviantart/a", Site: "deviantart", PostID: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reminders, err := s.getReminders()
+		if err != nil || len(reminders) != 1 {
+			t.Errorf("got reminders %+v, %v, want 1", reminders, err)
+		}
+		err = s.deleteReminder("deviantart/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reminders, err = s.getReminders()
+		if err != nil || len(reminders) != 0 {
+			t.Errorf("got reminders %+v, %v, want none", reminders, err)
+		}
+
+		for _, r := range []rule{{ID: 10, Action: ruleNever, Field: ruleFieldTag, Pattern: "ai"}, {ID: 2, Action: ruleAlways, Field: ruleFieldMature}} {
+			err = s.putRule(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = s.deleteRule(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules, err := s.getRules()
+		if err != nil || len(rules) != 1 || rules[0].ID != 2 {
+			t.Errorf("got rules %+v, %v, want rule 2", rules, err)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	runtimeDebug "runtime/debug"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Backoff between restarts of a failed component. It doubles on each consecutive failure.
+const supervisorMinBackoff = time.Second
+const supervisorMaxBackoff = 10 * time.Minute
+
+// A component that runs for this long without failing is considered healthy again, resetting its backoff.
+const supervisorResetAfter = 10 * time.Minute
+
+// supervise runs a long-lived component until it returns nil or ctx is cancelled.
+// If the component returns an error or panics, the failure is reported to the telegram chat and the component is restarted after a backoff.
+func supervise(ctx context.Context, name string, run func(context.Context) error) {
+	backoff := supervisorMinBackoff
+
+	for {
+		started := time.Now()
+		err := runRecovered(ctx, run)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		// If the component was healthy for a while, this is a new failure rather than a repeat.
+		if time.Since(started) > supervisorResetAfter {
+			backoff = supervisorMinBackoff
+		}
+
+		reportError(name, fmt.Errorf("%w\nRestarting in %s.", err, backoff))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > supervisorMaxBackoff {
+			backoff = supervisorMaxBackoff
+		}
+	}
+}
+
+// runRecovered runs a component, converting a panic into an error.
+func runRecovered(ctx context.Context, run func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			log.Printf("%s\n%s", err, runtimeDebug.Stack())
+		}
+	}()
+	return run(ctx)
+}
+
+// reportError logs an error from part of the system and sends it to the telegram chat.
+func reportError(source string, err error) {
+	log.Printf("Error in %s: %s\n", source, err)
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("⚠️ Error in %s:\n%s", source, err))
+	_, sendErr := telegramBot.Send(msg)
+	if sendErr != nil {
+		log.Printf("Failed to report error to telegram.\nError: %s\n", sendErr)
+	}
+}
@@ -1,35 +1,118 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"html"
 	"log"
-	"net/http"
+	"math"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
-func sendShutdownMessage(r interface{}) {
-	msgText := fmt.Sprint("Panic! Shuting down with following panic: /n", fmt.Sprint(r))
-	msg := tgbotapi.NewMessage(chatID, msgText)
+// sendMessage sends a reply to the telegram chat. Failures are logged, since there's nowhere else to report them.
+func sendMessage(msg tgbotapi.Chattable) {
+	_, err := telegramBot.Send(msg)
+	if err != nil {
+		log.Printf("Failed to send telegram message.\nError: %s\n", err)
+	}
+}
+
+// Telegram's limit on the length of a photo's caption, after entities are parsed.
+const captionLimit = 1024
+
+// Send a notification about a post to the telegram chat, saying what triggered it.
+func sendPost(post streamablePost, score float64, reason string) error {
+	return sendRichPost(post, fmt.Sprintf("%s\nReason: %s", formatScore(score), html.EscapeString(reason)))
+}
+
+// sendRichPost sends a post to the chat as its preview image, captioned with its title, author and tags, then the header and any commission details.
+// Posts without a preview, or whose image fails to send, are sent as text instead. Mature previews are hidden behind a spoiler.
+func sendRichPost(post streamablePost, header string) error {
+	text := post.formatCaption() + "\n\n" + header
+	if details := formatCommission(postCommission(post)); details != "" {
+		text += "\n" + html.EscapeString(details)
+	}
+	keyboard := postKeyboard(post)
+	mature := post.filterFields().Mature
+
+	if image := post.previewImage(); image != "" && captionLength(text) <= captionLimit {
+		err := sendPhoto(image, text, keyboard, mature)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to send preview of post %s, sending as text.\nError: %s\n", post.getID(), err)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text+"\n"+html.EscapeString(post.formatLink()))
+	msg.ParseMode = tgbotapi.ModeHTML
+	msg.DisableWebPagePreview = mature
+	msg.ReplyMarkup = keyboard
+	_, err := telegramBot.Send(msg)
+	return err
+}
+
+// sendPhoto sends an image by URL with an HTML caption.
+// The request is made directly, as this version of the library can't set has_spoiler.
+func sendPhoto(image string, caption string, keyboard tgbotapi.InlineKeyboardMarkup, spoiler bool) error {
+	markup, err := json.Marshal(keyboard)
+	if err != nil {
+		return err
+	}
+	params := url.Values{}
+	params.Set("chat_id", strconv.FormatInt(chatID, 10))
+	params.Set("photo", image)
+	params.Set("caption", caption)
+	params.Set("parse_mode", tgbotapi.ModeHTML)
+	params.Set("reply_markup", string(markup))
+	if spoiler {
+		params.Set("has_spoiler", "true")
+	}
+	_, err = telegramBot.MakeRequest("sendPhoto", params)
+	return err
+}
 
-	telegramBot.Send(msg)
+// captionLength approximates how long an HTML caption is once Telegram removes its tags and entities, in UTF-16 code units as Telegram counts them.
+func captionLength(caption string) int {
+	var plain strings.Builder
+	inTag := false
+	for _, r := range caption {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+		case !inTag:
+			plain.WriteRune(r)
+		}
+	}
+	length := 0
+	for _, r := range html.UnescapeString(plain.String()) {
+		length++
+		if r > 0xFFFF {
+			length++
+		}
+	}
+	return length
 }
 
-// Send a notification about a post to the telegram chat.
-func sendPost(post streamablePost, score float64) {
-	// Make message with score and link
-	msgText := fmt.Sprintf("Score: %.2f\n%s", score, post.formatLink())
-	msg := tgbotapi.NewMessage(chatID, msgText)
-	formatReplyMarkup(post, score, &msg)
-	telegramBot.Send(msg)
+// formatScore prints a classifier score. A NaN score means the post couldn't be classified.
+func formatScore(score float64) string {
+	if math.IsNaN(score) {
+		return "Score: unavailable"
+	}
+	return fmt.Sprintf("Score: %.2f", score)
 }
 
-func formatReplyMarkup(post streamablePost, score float64, msg *tgbotapi.MessageConfig) {
+// postKeyboard returns the buttons sent with a post's notification.
+func postKeyboard(post streamablePost) tgbotapi.InlineKeyboardMarkup {
 	// Define inline keyboard
-	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
 		tgbotapi.NewInlineKeyboardRow(
 			tgbotapi.NewInlineKeyboardButtonURL("🔗", post.formatLink()),
 			tgbotapi.NewInlineKeyboardButtonData("💬", fmt.Sprintf("cb_print %s %s", post.siteName(), post.getID())),
@@ -43,6 +126,13 @@ func formatReplyMarkup(post streamablePost, score float64, msg *tgbotapi.Message
 			tgbotapi.NewInlineKeyboardButtonData("🗑", fmt.Sprintf("cb_delete %s %s", post.siteName(), post.getID())),
 		),
 	)
+	// Posts with a deadline are sent again shortly before it, unless the reminder is cancelled.
+	if _, _, ok := reminderDue(post); ok {
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔕", fmt.Sprintf("cb_remind_off %s %s", post.siteName(), post.getID())),
+		))
+	}
+	return keyboard
 }
 
 func siteSelectKeyboard() tgbotapi.ReplyKeyboardMarkup {
@@ -56,47 +146,62 @@ func siteSelectKeyboard() tgbotapi.ReplyKeyboardMarkup {
 	return keyboard
 }
 
-func followHandler(update tgbotapi.Update) (waitForResponse bool, responseHandler interface{}) {
+func followHandler(update tgbotapi.Update) stepHandler {
 
 	site, returnErr := parseSiteName(update.Message.Text)
 	if returnErr != nil {
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Invalid site name, please restart. ")
-		_, err := telegramBot.Send(msg)
-		if err != nil {
-			log.Panicln(err)
-		}
-		return false, nil
+		sendMessage(msg)
+		return nil
 	}
 
-	return true, site.addFollowHandler()
+	return site.addFollowHandler(update.Message.Chat.ID)
 }
 
-// telegramCallbackHandler defines a goroutine that responds to messages and callbacks from the telegram chat.
-func telegramCallbackHandler(downloadQueue chan<- postMessage) {
-	// Create updates channel.
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates, err := telegramBot.GetUpdatesChan(u)
-	if err != nil {
-		log.Panicln(err)
-	}
+// telegramCallbackHandler defines a goroutine that responds to messages and callbacks from the telegram chat until ctx is cancelled.
+func telegramCallbackHandler(ctx context.Context, updates tgbotapi.UpdatesChannel, downloadQueue chan<- postMessage) error {
+	log.Println("Started telegram callback handler.")
 
-	// Keep track of a if there's an expected response.
-	var waitingForResponse bool = false
-	// Function to handle next step in a thread of commands.
-	var responseHandler func(tgbotapi.Update) (bool, interface{})
+	// Check for abandoned conversations.
+	conversationCheck := time.NewTicker(time.Minute)
+	defer conversationCheck.Stop()
+
+	for {
+		var update tgbotapi.Update
+		select {
+		case <-ctx.Done():
+			log.Println("Stopped telegram callback handler.")
+			return nil
+		case <-conversationCheck.C:
+			expireConversations()
+			continue
+		case update = <-updates:
+		}
 
-	log.Println("Started telegram callback handler.")
+		// Ignore anyone who isn't allowed to talk to the bot, without replying.
+		senderRole := updateRole(update)
+		if senderRole == roleNone {
+			logUnauthorised(update)
+			continue
+		}
 
-	for update := range updates {
 		switch {
 		case update.CallbackQuery != nil:
 			// If update is a callback, handle the keyboard button
+			fields := strings.Fields(update.CallbackQuery.Data)
+			if len(fields) != 3 {
+				telegramBot.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, ""))
+				log.Printf("Ignoring malformed callback \"%s\"\n", update.CallbackQuery.Data)
+				continue
+			}
+			button := fields[0]
+			if senderRole < callbackRole(button) {
+				telegramBot.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, "Sorry, you don't have permission to do that."))
+				continue
+			}
 			// Answer callback.
 			telegramBot.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, ""))
 
-			fields := strings.Fields(update.CallbackQuery.Data)
-			button := fields[0]
 			site := fields[1]
 			id := fields[2]
 			// Switch over each button
@@ -109,7 +214,12 @@ func telegramCallbackHandler(downloadQueue chan<- postMessage) {
 				}
 			case "cb_delete":
 				// Delete post from the database.
-				deletePost(site, id)
+				err := db.deletePost(site, id)
+				if err != nil {
+					log.Printf("Failed to delete post %s.\nError: %s\n", id, err)
+					sendMessage(tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, "Sorry, I couldn't delete that post from the database."))
+					break
+				}
 				// Hide message.
 				telegramBot.DeleteMessage(tgbotapi.NewDeleteMessage(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Message.MessageID))
 				if debug {
@@ -117,57 +227,85 @@ func telegramCallbackHandler(downloadQueue chan<- postMessage) {
 				}
 			case "cb_true":
 				// Update post notify status
-				updatePostNotify(site, id, true)
+				err := db.updatePostNotify(site, id, true)
+				if err != nil {
+					log.Printf("Failed to label post %s.\nError: %s\n", id, err)
+					sendMessage(tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, "Sorry, I couldn't save that label."))
+					break
+				}
 				log.Printf("Set notification true on post %s\n", id)
+				// Poll the post's feed more often.
+				recordPositiveLabel(site, id)
 			case "cb_false":
 				// Update post notify status.
-				updatePostNotify(site, id, false)
+				err := db.updatePostNotify(site, id, false)
+				if err != nil {
+					log.Printf("Failed to label post %s.\nError: %s\n", id, err)
+					sendMessage(tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, "Sorry, I couldn't save that label."))
+					break
+				}
 				if debug {
 					log.Printf("Set notification false on post %s\n", id)
 				}
+			case "cb_remind_off":
+				err := db.deleteReminder(queueKey(site, id))
+				if err != nil {
+					log.Printf("Failed to cancel the reminder for post %s.\nError: %s\n", id, err)
+					sendMessage(tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, "Sorry, I couldn't cancel that reminder."))
+					break
+				}
+				sendMessage(tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, "Cancelled the reminder for that post."))
+			case "cb_unfollow", "cb_pause", "cb_resume":
+				// Replace the feed picker with the result. The id is the feed's token.
+				telegramBot.DeleteMessage(tgbotapi.NewDeleteMessage(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Message.MessageID))
+				sendMessage(tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, applyFeedButton(button, site, id)))
 			case "cb_print":
-				post, err := getPost(site, id)
+				post, err := db.getPost(site, id)
 
 				if err != nil {
-					log.Fatalf("Got callback on post %s but could not find it in database.", id)
+					log.Printf("Got callback on post %s but could not find it in database.\nError: %s\n", id, err)
+					sendMessage(tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, "Sorry, I couldn't find that post in the database."))
+					break
 				}
 
 				// Update post with a new score.
-				result := classifyPost(post)
-				score := result.Score
+				score := math.NaN()
+				result, err := classifier.classify(ctx, post)
+				if err != nil {
+					log.Printf("Failed to classify post %s.\nError: %s\n", id, err)
+				} else {
+					score = result.Score
+				}
 
 				// Delete the old message.
 				telegramBot.DeleteMessage(tgbotapi.NewDeleteMessage(update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Message.MessageID))
 
-				msg := tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, fmt.Sprintf("Score: %.2f\n%s", score, post.formatPost()))
-				formatReplyMarkup(post, score, &msg)
+				msg := tgbotapi.NewMessage(update.CallbackQuery.Message.Chat.ID, fmt.Sprintf("%s\n%s", formatScore(score), post.formatPost()))
+				msg.ReplyMarkup = postKeyboard(post)
 
 				_, err = telegramBot.Send(msg)
 				if err != nil {
 					if err.Error() == "Bad Request: message is too long" {
 						// TODO: Better handling of too-long posts.
 						log.Printf("Error: post %s too long\n", post.getID())
-						sendPost(post, score)
-					} else {
-						log.Panicln(err)
+						err = sendPost(post, score, "requested")
+					}
+					if err != nil {
+						log.Printf("Failed to send post %s.\nError: %s\n", post.getID(), err)
 					}
 				}
 			}
 
-		case update.Message != nil && waitingForResponse:
-			var newResponseHandler interface{}
-			// If waiting for a response and got a message, run the response handler.
-			waitingForResponse, newResponseHandler = responseHandler(update)
-			// If still waiting for a response, cast the handler.
-			if waitingForResponse {
-				responseHandler = newResponseHandler.(func(tgbotapi.Update) (bool, interface{}))
-			} else {
-				responseHandler = nil
-			}
+		case update.Message != nil && !update.Message.IsCommand() && continueConversation(update):
+			// The message was a reply in a conversation.
 
 		case update.Message != nil && update.Message.IsCommand():
 			// If the message is a command, perform the action.
 			var msg tgbotapi.MessageConfig
+			if senderRole < commandRole(update.Message.Command(), strings.Fields(update.Message.CommandArguments())) {
+				sendMessage(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Sorry, you don't have permission to use /%s.", update.Message.Command())))
+				continue
+			}
 			switch update.Message.Command() {
 			case "start":
 				msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Welcome! Try /help to get a list of commands.")
@@ -179,18 +317,114 @@ Currently implemented sites:
 Commands:
 	* /help - Print this message.
 	* /follow - Begin a dialogue to add a new data stream to Wagyl's followed users. 
+	* /cancel - Cancel the current dialogue.
+	* /follows - List the followed feeds, with when each was last polled and how many posts it has found.
+	* /unfollow [site feed] - Stop following a feed. With no arguments, pick the feed from a list.
+	* /pause [site feed] - Stop polling a feed until it's resumed. With no arguments, pick the feed from a list.
+	* /resume [site feed] - Start polling a paused feed again. With no arguments, pick the feed from a list.
+	* /hot site feed [on|off] - Always poll a DeviantArt feed at the minimum delay, or go back to learning how often to poll it.
 	* /add site post_id - Add a post to the database and request it to be labelled.
 	* /label site count - Get count posts from site to be labelled. Posts are chosen to maximise the training of the site's notification model.
 	* /retrain [site] - Retrain a site's notification model. TODO - If no site is specified, all sites will be retrained.
 	* /stats [site] - Print statistics about a certain site. If no site is specified, all site statistics will be printed. TODO - Currently unimplemented.
+	* /status - Check whether the classifier is reachable, and show how many DeviantArt API requests have been made.
+	* /rule add always|never author|tag|text|mature [pattern] - Always or never notify posts by an author, with a tag, with text matching a regular expression, or marked mature. Rules are checked before classification, and a post matching one isn't scored. Never rules win over always rules.
+	* /rule list - List the rules.
+	* /rule rm id - Remove a rule.
+	* /threshold [site [feed] value] - Set the score a site's or feed's posts must beat to be notified. Use reset as the value to remove it. With no arguments, list the thresholds.
+	* /deadletters - List posts that failed classification too many times.
+	* /replay site post_id - Queue a dead letter to be classified again. Use /replay all to queue every dead letter.
 `)
 			case "follow":
 				// Open a dialogue to add a new query to the follow list.
 				msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Which site do you want to add a follow for?")
 				msg.ReplyMarkup = siteSelectKeyboard()
-				// Save that we're waiting for a response.
-				waitingForResponse = true
-				responseHandler = followHandler
+				// Wait for this user's response.
+				startConversation(messageConversationKey(update.Message), "follow", followHandler)
+			case "follows":
+				text, err := formatFeeds()
+				if err != nil {
+					log.Printf("Failed to list feeds.\nError: %s\n", err)
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I couldn't read the feeds.")
+					break
+				}
+				msg = tgbotapi.NewMessage(update.Message.Chat.ID, text)
+			case "hot":
+				msg = tgbotapi.NewMessage(update.Message.Chat.ID, hotCommand(strings.Fields(update.Message.CommandArguments())))
+			case "unfollow", "pause", "resume":
+				msg = feedCommand(update.Message.Chat.ID, update.Message.Command(), strings.Fields(update.Message.CommandArguments()))
+			case "cancel":
+				command := cancelConversation(messageConversationKey(update.Message))
+				if command == "" {
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, "There's nothing to cancel.")
+				} else {
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Cancelled /%s.", command))
+				}
+				msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(false)
+			case "status":
+				// Probe the classifier's health, and report the DeviantArt API usage.
+				err := classifier.status(ctx)
+				var text string
+				if err != nil {
+					text = fmt.Sprintf("The classifier is down.\nError: %s\nPosts are handled with the \"%s\" fallback policy until it responds.", err, conf.Classifier.Fallback)
+				} else {
+					text = "The classifier is up."
+				}
+				msg = tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("%s\nDeviantArt API: %s.", text, dAClient.metrics))
+			case "rule":
+				msg = tgbotapi.NewMessage(update.Message.Chat.ID, ruleCommand(strings.Fields(update.Message.CommandArguments())))
+			case "threshold":
+				msg = tgbotapi.NewMessage(update.Message.Chat.ID, thresholdCommand(strings.Fields(update.Message.CommandArguments())))
+			case "deadletters":
+				entries, err := deadLetters()
+				if err != nil {
+					log.Printf("Failed to read dead letters.\nError: %s\n", err)
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I couldn't read the dead letters.")
+					break
+				}
+				msg = tgbotapi.NewMessage(update.Message.Chat.ID, formatDeadLetters(entries))
+			case "replay":
+				// Send dead letters back through the pipeline. The writer queues them again from the start.
+				arguments := strings.Fields(update.Message.CommandArguments())
+				entries, err := deadLetters()
+				if err != nil {
+					log.Printf("Failed to read dead letters.\nError: %s\n", err)
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I couldn't read the dead letters.")
+					break
+				}
+
+				var key string
+				if len(arguments) == 2 {
+					site, err := parseSiteName(arguments[0])
+					if err != nil {
+						msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I don't recognise that site. Check /help for the implemented sites.")
+						break
+					}
+					key = queueKey(site.siteName(), arguments[1])
+				} else if len(arguments) != 1 || arguments[0] != "all" {
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I don't know how to parse those parameters. Check /help for usage.")
+					break
+				}
+
+				replayed := 0
+				for _, entry := range entries {
+					if key != "" && entry.Key != key {
+						continue
+					}
+					post, err := db.getPost(entry.Site, entry.PostID)
+					if err != nil {
+						sendMessage(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Couldn't find post %s", entry.Key)))
+						continue
+					}
+					downloadQueue <- postMessage{
+						post:      post,
+						setNotify: entry.SetNotify,
+						skipWrite: true,
+						feed:      entry.Feed,
+					}
+					replayed++
+				}
+				msg = tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Replaying %d posts.", replayed))
 			case "retrain":
 				// Trigger a certain model to be retrained based on the latest data.
 				arguments := strings.Fields(update.Message.CommandArguments())
@@ -219,26 +453,11 @@ Commands:
 				}
 
 				// Request classifier for retraining.
-				// Send web request to the python script
-				params := url.Values{}
-				params.Add("site", siteName)
-				requestParams := params.Encode()
-				resp, err := http.Get(fmt.Sprintf("http://localhost:5000/retrain?%s", requestParams))
+				err := classifier.retrain(ctx, siteName)
 				if err != nil {
-					log.Panicln(err)
-				}
-
-				// Check if the retrain was successful and send an appropriate message.
-				var result struct {
-					Success bool
-					Error   string
-				}
-				json.NewDecoder(resp.Body).Decode(&result)
-
-				if result.Success {
-					msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Successfully retrained model.")
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Failed to retrain model \"%s\".\nError: %s\n", siteName, err))
 				} else {
-					msg = tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Failed to retrain model \"%s\".\nError: %s\n", siteName, result.Error))
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Successfully retrained model.")
 				}
 
 			case "stats":
@@ -268,28 +487,12 @@ Commands:
 					siteName = site.siteName()
 				}
 
-				// Request classifier for retraining.
-				// Send web request to the python script
-				params := url.Values{}
-				params.Add("site", siteName)
-				requestParams := params.Encode()
-				resp, err := http.Get(fmt.Sprintf("http://localhost:5000/stats?%s", requestParams))
+				// Request statistics from the classifier.
+				statistics, err := classifier.stats(ctx, siteName)
 				if err != nil {
-					log.Panicln(err)
-				}
-
-				// Check if the retrain was successful and send an appropriate message.
-				var result struct {
-					Success    bool
-					Statistics string
-					Error      string
-				}
-				json.NewDecoder(resp.Body).Decode(&result)
-
-				if result.Success {
-					msg = tgbotapi.NewMessage(update.Message.Chat.ID, result.Statistics)
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Failed to get statistics for model \"%s\".\nError: %s\n", siteName, err))
 				} else {
-					msg = tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Failed to get statistics for model \"%s\".\nError: %s\n", siteName, result.Error))
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, statistics)
 				}
 
 			case "label":
@@ -304,7 +507,7 @@ Commands:
 				}
 
 				siteArg := arguments[0]
-				count := arguments[1]
+				countArg := arguments[1]
 
 				site, err := parseSiteName(siteArg)
 				// Make sure site is valid.
@@ -312,33 +515,23 @@ Commands:
 					msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I don't recognise that site. Check /help for the implemented sites.")
 					break
 				}
+				count, err := strconv.Atoi(countArg)
+				if err != nil || count <= 0 {
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, the count must be a positive number.")
+					break
+				}
 
 				// Request classifier for labelling.
-				// Send web request to the python script
-				params := url.Values{}
-				params.Add("site", site.siteName())
-				params.Add("count", count)
-				requestParams := params.Encode()
-				resp, err := http.Get(fmt.Sprintf("http://localhost:5000/label?%s", requestParams))
+				ids, err := classifier.label(ctx, site.siteName(), count)
 				if err != nil {
-					log.Panicln(err)
-				}
-				// Decode the results
-				var result struct {
-					IDs  []string
-					Site string
+					msg = tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Failed to get posts to label.\nError: %s\n", err))
+					break
 				}
 
-				json.NewDecoder(resp.Body).Decode(&result)
-
-				for _, postID := range result.IDs {
-					post, err := getPost(siteArg, postID)
+				for _, postID := range ids {
+					post, err := db.getPost(site.siteName(), postID)
 					if err != nil {
-						msg = tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Couldn't find post %s", postID))
-						_, err := telegramBot.Send(msg)
-						if err != nil {
-							log.Panicln(err)
-						}
+						sendMessage(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Couldn't find post %s", postID)))
 						continue
 					}
 					message := postMessage{
@@ -387,19 +580,13 @@ Commands:
 			}
 
 			if msg.Text != "" {
-				_, err := telegramBot.Send(msg)
-				if err != nil {
-					log.Panicln(err)
-				}
+				sendMessage(msg)
 			}
 
-		default:
+		case update.Message != nil:
 			// If message isn't recognised, reply with error.
 			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I didn't understand what you said. Try /help for commands.")
-			_, err := telegramBot.Send(msg)
-			if err != nil {
-				log.Panicln(err)
-			}
+			sendMessage(msg)
 		}
 	}
 }
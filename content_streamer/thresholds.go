@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const thresholdCollection = "thresholds"
+
+// Ways of deciding whether a classified post is notified.
+const (
+	decisionThreshold = "threshold" // Notify posts scoring above their threshold.
+	decisionModel     = "model"     // Trust the classifier's own notify decision.
+)
+
+// threshold overrides the notification threshold of a site, or of a single feed within a site.
+type threshold struct {
+	Key   string  `bson:"_id"` // See thresholdKey.
+	Site  string  `bson:"site"`
+	Feed  string  `bson:"feed,omitempty"` // Empty for a site-wide threshold.
+	Value float64 `bson:"value"`
+}
+
+// thresholdKey returns the key of a threshold, which is unique by site and feed.
+func thresholdKey(site string, feed string) string {
+	if feed == "" {
+		return site
+	}
+	return site + "/" + feed
+}
+
+// Thresholds set from the telegram chat, cached from the store.
+var thresholds struct {
+	sync.RWMutex
+	byKey map[string]threshold
+}
+
+// loadThresholds reads the thresholds saved in the store into the cache.
+func loadThresholds() error {
+	saved, err := db.getThresholds()
+	if err != nil {
+		return err
+	}
+
+	thresholds.Lock()
+	defer thresholds.Unlock()
+	thresholds.byKey = make(map[string]threshold, len(saved))
+	for _, t := range saved {
+		thresholds.byKey[t.Key] = t
+	}
+	return nil
+}
+
+// notificationThreshold returns the score a post from a feed must beat to be notified.
+// A feed's threshold takes precedence over its site's, which takes precedence over the site's threshold in the config, then the default.
+func notificationThreshold(site string, feed string) float64 {
+	thresholds.RLock()
+	defer thresholds.RUnlock()
+
+	if t, ok := thresholds.byKey[thresholdKey(site, feed)]; ok && feed != "" {
+		return t.Value
+	}
+	if t, ok := thresholds.byKey[thresholdKey(site, "")]; ok {
+		return t.Value
+	}
+	if value, ok := conf.Classifier.SiteThresholds[site]; ok {
+		return value
+	}
+	return conf.Classifier.NotificationThreshold
+}
+
+// notifyDecision decides whether a classified post from a feed is worth notifying, and describes why.
+func notifyDecision(site string, feed string, result classificationResult) (bool, string) {
+	if conf.Classifier.Decision == decisionModel {
+		return result.Notify, "classifier's decision"
+	}
+	threshold := notificationThreshold(site, feed)
+	return result.Score > threshold, fmt.Sprintf("score above the %.2f threshold", threshold)
+}
+
+// setThreshold saves a threshold to the store and the cache.
+func setThreshold(t threshold) error {
+	err := db.putThreshold(t)
+	if err != nil {
+		return err
+	}
+
+	thresholds.Lock()
+	defer thresholds.Unlock()
+	thresholds.byKey[t.Key] = t
+	return nil
+}
+
+// resetThreshold removes a threshold from the store and the cache, so the next most specific threshold applies.
+func resetThreshold(key string) error {
+	err := db.deleteThreshold(key)
+	if err != nil {
+		return err
+	}
+
+	thresholds.Lock()
+	defer thresholds.Unlock()
+	delete(thresholds.byKey, key)
+	return nil
+}
+
+// formatThresholds lists the default threshold and every override for the telegram chat.
+func formatThresholds() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Default threshold: %.2f\n", conf.Classifier.NotificationThreshold)
+	if conf.Classifier.Decision == decisionModel {
+		builder.WriteString("Thresholds are currently ignored, as the classifier's own decision is used.\n")
+	}
+
+	sites := make([]string, 0, len(conf.Classifier.SiteThresholds))
+	for site := range conf.Classifier.SiteThresholds {
+		sites = append(sites, site)
+	}
+	sort.Strings(sites)
+	for _, site := range sites {
+		fmt.Fprintf(&builder, "• %s (config): %.2f\n", site, conf.Classifier.SiteThresholds[site])
+	}
+
+	thresholds.RLock()
+	keys := make([]string, 0, len(thresholds.byKey))
+	for key := range thresholds.byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		t := thresholds.byKey[key]
+		fmt.Fprintf(&builder, "• %s: %.2f\n", strings.TrimSpace(t.Site+" "+t.Feed), t.Value)
+	}
+	thresholds.RUnlock()
+
+	return builder.String()
+}
+
+// thresholdCommand handles the arguments of the /threshold command, returning the reply.
+// The forms are "site [feed] value" to set a threshold, "site [feed] reset" to remove it, and no arguments to list them.
+func thresholdCommand(arguments []string) string {
+	if len(arguments) == 0 {
+		return formatThresholds()
+	}
+	if len(arguments) != 2 && len(arguments) != 3 {
+		return "Sorry, I don't know how to parse those parameters. Check /help for usage."
+	}
+
+	site, err := parseSiteName(arguments[0])
+	if err != nil {
+		return "Sorry, I don't recognise that site. Check /help for the implemented sites."
+	}
+
+	var feed string
+	if len(arguments) == 3 {
+		feed = arguments[1]
+		names, err := feedNames(site)
+		if err != nil {
+			return fmt.Sprintf("Sorry, I couldn't read the %s feeds.\nError: %s", site.prettySiteName(), err)
+		}
+		if !containsString(names, feed) {
+			return fmt.Sprintf("Sorry, I'm not following %s on %s.", feed, site.prettySiteName())
+		}
+	}
+	key := thresholdKey(site.siteName(), feed)
+
+	valueArg := arguments[len(arguments)-1]
+	if valueArg == "reset" {
+		err = resetThreshold(key)
+		if err != nil {
+			return fmt.Sprintf("Sorry, I couldn't reset that threshold.\nError: %s", err)
+		}
+		return fmt.Sprintf("Reset the threshold. Posts from %s now need a score above %.2f.", key, notificationThreshold(site.siteName(), feed))
+	}
+
+	value, err := strconv.ParseFloat(valueArg, 64)
+	if err != nil || !validThreshold(value) {
+		return "Sorry, the threshold must be a number from 0 to 1, or \"reset\"."
+	}
+	err = setThreshold(threshold{Key: key, Site: site.siteName(), Feed: feed, Value: value})
+	if err != nil {
+		return fmt.Sprintf("Sorry, I couldn't save that threshold.\nError: %s", err)
+	}
+	return fmt.Sprintf("Posts from %s now need a score above %.2f.", key, value)
+}
+
+// validThreshold reports whether a threshold is a score, from 0 to 1. NaN and infinities aren't.
+func validThreshold(value float64) bool {
+	return value >= 0 && value <= 1
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestThresholdCommandValues(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"0.5", true},
+		{"0", true},
+		{"1", true},
+		{"-0.1", false},
+		{"1.5", false},
+		{"NaN", false},
+		{"Inf", false},
+		{"-Inf", false},
+		{"high", false},
+	}
+	for _, test := range tests {
+		conf = defaultConfig()
+		db = newMemoryStore()
+		err := loadThresholds()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := thresholdCommand([]string{"deviantart", test.value})
+		saved, err := db.getThresholds()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.ok && (len(saved) != 1 || !strings.HasPrefix(reply, "Posts from deviantart")) {
+			t.Errorf("threshold %s replied %q and saved %+v, want it set", test.value, reply, saved)
+		}
+		if !test.ok && (len(saved) != 0 || !strings.Contains(reply, "from 0 to 1")) {
+			t.Errorf("threshold %s replied %q and saved %+v, want it rejected", test.value, reply, saved)
+		}
+	}
+}
+
+func TestValidateThresholds(t *testing.T) {
+	c := defaultConfig()
+	c.Classifier.NotificationThreshold = 2
+	c.Classifier.SiteThresholds = map[string]float64{"twitter": -1}
+	err := c.validate()
+	if err == nil || !strings.Contains(err.Error(), "notification_threshold") || !strings.Contains(err.Error(), "site_thresholds for twitter") {
+		t.Errorf("got %v, want both thresholds rejected", err)
+	}
+}
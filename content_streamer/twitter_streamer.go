@@ -2,37 +2,339 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"log"
+	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 const twitterFeedCollection = "twitterFeeds"
 
-// tweet implements the WebsitePost interface, represeting a tweet drawn from twitter.
+// Maximum number of tweets requested per timeline page (API maximum is 100).
+const twitterPageSize = 100
+
+var twitterClient = &http.Client{Timeout: 30 * time.Second}
+
+// tweet implements the streamablePost interface, represeting a tweet drawn from twitter.
 type tweet struct {
-	Id   string
-	json []byte
+	ID         string             `json:"id" bson:"_id"`
+	Text       string             `json:"text" bson:"text"`
+	AuthorID   string             `json:"author_id" bson:"author_id"`
+	Username   string             `json:"-" bson:"username"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+	Commission *commissionDetails `json:"-" bson:"commission,omitempty"` // Commission terms found in the text.
 }
 
+// twitterFeed defines a user timeline to pull tweets from.
 type twitterFeed struct {
-	Username     string `bson:"username"`
-	LastPostTime int64  `bson:"last_post_time"`
+	Username      string    `bson:"username"`
+	UserID        string    `bson:"user_id"` // Cached user id, looked up from the username on first poll.
+	LastQueryTime time.Time `bson:"last_query_time"`
+	LastPostTime  int64     `bson:"last_post_time"`
+	LastPostID    string    `bson:"last_post_id"` // Newest tweet seen. Feeds polled before it was kept only have LastPostTime.
+	Paused        bool      `bson:"paused"`
+	PostCount     int       `bson:"post_count"`
+}
+
+// twitterError is an entry in the "errors" list returned by the Twitter API.
+type twitterError struct {
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+// twitterUser is the subset of the Twitter user object that we use.
+type twitterUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// twitterGet sends an authenticated GET request to the Twitter API and decodes the response into result.
+func twitterGet(ctx context.Context, path string, params url.Values, result interface{}) error {
+	if conf.Twitter.BearerToken == "" {
+		return errors.New("twitter bearer token is not set")
+	}
+
+	requestURL := fmt.Sprintf("%s%s", strings.TrimSuffix(conf.Twitter.APIURL, "/"), path)
+	if len(params) > 0 {
+		requestURL = fmt.Sprintf("%s?%s", requestURL, params.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+conf.Twitter.BearerToken)
+
+	resp, err := twitterClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("twitter request to %s failed with status %s", path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
 }
 
-func (tweet) createDownloadStream(downloadQueue chan<- postMessage, workers int) {
-	// TODO: implement
+// joinTwitterErrors formats the "errors" list of a Twitter response as a single error.
+func joinTwitterErrors(errs []twitterError) error {
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.Title, e.Detail))
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// getTwitterUser looks up a user by their username.
+func getTwitterUser(ctx context.Context, username string) (twitterUser, error) {
+	var result struct {
+		Data   *twitterUser   `json:"data"`
+		Errors []twitterError `json:"errors"`
+	}
+	err := twitterGet(ctx, fmt.Sprintf("/users/by/username/%s", url.PathEscape(username)), nil, &result)
+	if err != nil {
+		return twitterUser{}, err
+	}
+	if result.Data == nil {
+		if len(result.Errors) > 0 {
+			return twitterUser{}, joinTwitterErrors(result.Errors)
+		}
+		return twitterUser{}, fmt.Errorf("twitter user %s not found", username)
+	}
+	return *result.Data, nil
+}
+
+// getTimeline downloads the tweets in a feed posted after its LastPostID, or its LastPostTime if it has no id yet, newest first.
+func (f twitterFeed) getTimeline(ctx context.Context) ([]tweet, error) {
+	tweets := make([]tweet, 0)
+	paginationToken := ""
+
+	for page := 0; page < conf.Polling.MaxPages; page++ {
+		params := url.Values{}
+		params.Add("max_results", fmt.Sprint(twitterPageSize))
+		params.Add("tweet.fields", "created_at,author_id")
+		if f.LastPostID != "" {
+			params.Add("since_id", f.LastPostID)
+		} else if f.LastPostTime > 0 {
+			params.Add("start_time", time.Unix(f.LastPostTime, 0).UTC().Format(time.RFC3339))
+		}
+		if paginationToken != "" {
+			params.Add("pagination_token", paginationToken)
+		}
+
+		var result struct {
+			Data   []tweet        `json:"data"`
+			Errors []twitterError `json:"errors"`
+			Meta   struct {
+				NextToken string `json:"next_token"`
+			} `json:"meta"`
+		}
+		err := twitterGet(ctx, fmt.Sprintf("/users/%s/tweets", f.UserID), params, &result)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Data) == 0 && len(result.Errors) > 0 {
+			return nil, joinTwitterErrors(result.Errors)
+		}
+
+		for _, t := range result.Data {
+			// since_id is exclusive, but start_time is inclusive, so skip anything we've already seen.
+			if f.LastPostID == "" && t.CreatedAt.Unix() <= f.LastPostTime {
+				return tweets, nil
+			}
+			t.Username = f.Username
+			t.Commission = extractCommission(strings.Join(t.filterFields().Text, "\n"), t.CreatedAt)
+			tweets = append(tweets, t)
+		}
+
+		// If we're out of tweets, quit the loop.
+		if result.Meta.NextToken == "" {
+			break
+		}
+		paginationToken = result.Meta.NextToken
+	}
+
+	return tweets, nil
+}
+
+// newerTweetID reports whether tweet id a was posted after b. Ids are decimal strings that increase over time.
+func newerTweetID(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// pollTwitterFeed downloads the new tweets in a feed, puts them in the write queue and advances the feed in the database.
+// If ctx is cancelled while downloading, the feed is left as it was.
+func pollTwitterFeed(ctx context.Context, feed twitterFeed, writeQueue chan<- postMessage) error {
+
+	if debug {
+		log.Printf("Polling twitter feed \"%s\"\n", feed.Username)
+	}
+
+	// Look up and cache the user id the first time a feed is polled.
+	if feed.UserID == "" {
+		user, err := getTwitterUser(ctx, feed.Username)
+		if err != nil {
+			return err
+		}
+		feed.UserID = user.ID
+	}
+
+	tweets, err := feed.getTimeline(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A feed that's never been polled is new.
+	newFeed := feed.LastPostTime == 0 && feed.LastPostID == ""
+
+	newLastPostTime := feed.LastPostTime
+	newLastPostID := feed.LastPostID
+	for i, t := range tweets {
+		var setNotify *bool
+
+		// If the feed is new, force notifications for the most recent few posts, and suppress all others.
+		if newFeed {
+			setNotify = BoolPointer(i < conf.Polling.NewFeedNotificationLimit)
+		}
+
+		if t.CreatedAt.Unix() > newLastPostTime {
+			newLastPostTime = t.CreatedAt.Unix()
+		}
+		if newerTweetID(t.ID, newLastPostID) {
+			newLastPostID = t.ID
+		}
+
+		writeQueue <- postMessage{
+			post:      t,
+			setNotify: setNotify,
+			skipWrite: false,
+			feed:      feed.Username,
+		}
+	}
+
+	feed.LastQueryTime = time.Now()
+	feed.LastPostTime = newLastPostTime
+	feed.LastPostID = newLastPostID
+	feed.PostCount += len(tweets)
+
+	// Update the feed object in the database.
+	return db.updateTwitterFeed(feed)
+}
+
+// twitterDownloadWorker defines a goroutine which polls feeds from the feed queue until it is empty or ctx is cancelled.
+func twitterDownloadWorker(ctx context.Context, feedQueue <-chan twitterFeed, writeQueue chan<- postMessage) error {
+	for feed := range feedQueue {
+		if ctx.Err() != nil {
+			return nil
+		}
+		// Skip feeds paused or unfollowed since the round started.
+		if feedPaused("twitter", feed.Username) || feedRemoved("twitter", feed.Username) {
+			continue
+		}
+		err := pollTwitterFeed(ctx, feed, writeQueue)
+		if err != nil && ctx.Err() == nil && !feedRemoved("twitter", feed.Username) {
+			reportError(fmt.Sprintf("twitter feed \"%s\"", feed.Username), err)
+		}
+	}
+	return nil
+}
+
+// createDownloadStream spawns goroutines that poll every followed twitter user once per polling delay, until ctx is cancelled.
+func (tweet) createDownloadStream(ctx context.Context, writeQueue chan<- postMessage, workers int) error {
+
+	if conf.Twitter.BearerToken == "" {
+		log.Println("No Twitter bearer token found. Twitter streaming disabled.")
+		return nil
+	}
+
+	log.Printf("Started Twitter streaming with %d workers.\n", workers)
+
+	for {
+		// Feeds are re-read every round so that follows added through telegram are picked up.
+		feeds, err := db.getTwitterFeeds()
+		if err != nil {
+			return fmt.Errorf("failed to read twitter feeds: %w", err)
+		}
+
+		feedQueue := make(chan twitterFeed, len(feeds))
+		for _, feed := range feeds {
+			if feed.Paused {
+				continue
+			}
+			feedQueue <- feed
+		}
+		close(feedQueue)
+
+		// Split the feeds between the workers and wait for the round to finish.
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				supervise(ctx, fmt.Sprintf("Twitter worker %d", i), func(ctx context.Context) error {
+					return twitterDownloadWorker(ctx, feedQueue, writeQueue)
+				})
+			}(i)
+		}
+		wg.Wait()
+
+		select {
+		case <-time.After(conf.Polling.Delay):
+		case <-ctx.Done():
+			log.Println("Stopped Twitter workers.")
+			return nil
+		}
+	}
 }
 
 func (t tweet) formatLink() string {
-	return fmt.Sprintf("http://twitter.com/statuses/%s", t.Id)
+	if t.Username == "" {
+		return fmt.Sprintf("https://twitter.com/i/web/status/%s", t.ID)
+	}
+	return fmt.Sprintf("https://twitter.com/%s/status/%s", t.Username, t.ID)
+}
+
+func (t tweet) formatPost() string {
+	return fmt.Sprintf("@%s\n"+
+		"--------------------------------------------------------------------------------------\n"+
+		"%s", t.Username, t.Text)
+}
+
+func (t tweet) formatCaption() string {
+	return fmt.Sprintf("<b>@%s</b>\n%s", html.EscapeString(t.Username), html.EscapeString(t.Text))
 }
 
-func (f tweet) formatPost() string {
-	panic("not implemented") // TODO: Implement
+// previewImage returns "", as media isn't requested with tweets.
+func (tweet) previewImage() string {
+	return ""
+}
+
+func (t tweet) filterFields() postFields {
+	// Treat hashtags as tags.
+	var tags []string
+	for _, word := range strings.Fields(t.Text) {
+		if strings.HasPrefix(word, "#") {
+			tags = append(tags, strings.TrimRight(strings.TrimPrefix(word, "#"), ".,!?:;"))
+		}
+	}
+	return postFields{
+		Author: t.Username,
+		Tags:   tags,
+		Text:   []string{t.Text},
+	}
 }
 
 func (tweet) siteName() string {
@@ -44,24 +346,24 @@ func (tweet) prettySiteName() string {
 }
 
 func (t tweet) getID() string {
-	return string(t.Id)
+	return t.ID
 }
 
-func (f tweet) addFollowHandler() func(tgbotapi.Update) (bool, interface{}) {
+func (f tweet) addFollowHandler(chatID int64) stepHandler {
 
 	msg := tgbotapi.NewMessage(chatID, "What user would you like to add?")
-	telegramBot.Send(msg)
+	sendMessage(msg)
 
 	return handleAddUser
 }
 
-func handleAddUser(update tgbotapi.Update) (bool, interface{}) {
+func handleAddUser(update tgbotapi.Update) stepHandler {
 
 	// Check string contains whitespace, in which case break.
 	if len(strings.Fields(update.Message.Text)) != 1 {
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID, "Invalid user - user must not contain whitespace.")
-		telegramBot.Send(msg)
-		return false, nil
+		sendMessage(msg)
+		return nil
 	}
 
 	username := strings.ToLower(update.Message.Text)
@@ -69,6 +371,10 @@ func handleAddUser(update tgbotapi.Update) (bool, interface{}) {
 	if username[0:1] == "@" {
 		username = username[1:]
 	}
+	if username == "" {
+		sendMessage(tgbotapi.NewMessage(update.Message.Chat.ID, "Invalid user - user must not be empty."))
+		return nil
+	}
 
 	// Create a new feed from the parameters and insert it.
 	newFeed := twitterFeed{
@@ -76,25 +382,89 @@ func handleAddUser(update tgbotapi.Update) (bool, interface{}) {
 		LastPostTime: 0,
 	}
 
-	_, err := database.Collection(twitterFeedCollection).InsertOne(context.TODO(), newFeed)
+	err := db.insertTwitterFeed(newFeed)
 	if err != nil {
-		log.Panicln(err)
+		log.Printf("Failed to add twitter feed \"%s\".\nError: %s\n", username, err)
+		sendMessage(tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I couldn't save that feed. Please try again."))
+		return nil
 	}
+	forgetRemovedFeed("twitter", username)
 
 	// Send message to confirm.
 	msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Added feed with username \"%s\"!", username))
-	_, err = telegramBot.Send(msg)
+	sendMessage(msg)
+
+	return nil
+}
+
+func (tweet) getFeeds() ([]feedSummary, error) {
+	feeds, err := db.getTwitterFeeds()
 	if err != nil {
-		log.Panicln(err)
+		return nil, err
+	}
+	summaries := make([]feedSummary, 0, len(feeds))
+	for _, feed := range feeds {
+		summaries = append(summaries, feedSummary{
+			Name:          feed.Username,
+			LastQueryTime: feed.LastQueryTime,
+			PostCount:     feed.PostCount,
+			Paused:        feed.Paused,
+		})
 	}
+	return summaries, nil
+}
+
+func (tweet) setFeedPaused(name string, paused bool) error {
+	return db.setTwitterFeedPaused(name, paused)
+}
 
-	return false, nil
+func (tweet) removeFeed(name string) error {
+	return db.deleteTwitterFeed(name)
 }
 
-func (f tweet) downloadPost(_ string) (postMessage, error) {
-	panic("not implemented") // TODO: Implement
+func (tweet) downloadPost(id string) (postMessage, error) {
+	params := url.Values{}
+	params.Add("tweet.fields", "created_at,author_id")
+	params.Add("expansions", "author_id")
+	params.Add("user.fields", "username")
+
+	var result struct {
+		Data     *tweet         `json:"data"`
+		Errors   []twitterError `json:"errors"`
+		Includes struct {
+			Users []twitterUser `json:"users"`
+		} `json:"includes"`
+	}
+	err := twitterGet(context.TODO(), fmt.Sprintf("/tweets/%s", url.PathEscape(id)), params, &result)
+	if err != nil {
+		return postMessage{}, err
+	}
+	if result.Data == nil {
+		if len(result.Errors) > 0 {
+			return postMessage{}, joinTwitterErrors(result.Errors)
+		}
+		return postMessage{}, errors.New("tweet not found")
+	}
+
+	post := *result.Data
+	// Fill in the author's username from the expanded users.
+	for _, user := range result.Includes.Users {
+		if user.ID == post.AuthorID {
+			post.Username = strings.ToLower(user.Username)
+		}
+	}
+	post.Commission = extractCommission(strings.Join(post.filterFields().Text, "\n"), post.CreatedAt)
+
+	return postMessage{
+		post:      post,
+		setNotify: nil,
+		skipWrite: false,
+	}, nil
 }
 
-func (f tweet) decodeDBResult(_ *mongo.SingleResult) (streamablePost, error) {
-	panic("not implemented") // TODO: Implement
+func (tweet) decodeDBResult(decode func(interface{}) error) (result streamablePost, err error) {
+	post := tweet{}
+	err = decode(&post)
+	result = post
+	return
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTwitter starts a server standing in for the v2 API, and points the config and store at it for the rest of the test.
+func fakeTwitter(t *testing.T, handler http.HandlerFunc) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	conf = defaultConfig()
+	conf.Twitter.BearerToken = "token"
+	conf.Twitter.APIURL = server.URL
+	db = newMemoryStore()
+}
+
+// tweetJSON formats a tweet as the API returns it.
+func tweetJSON(id string, created time.Time) string {
+	return fmt.Sprintf(`{"id":"%s","text":"tweet %s","author_id":"42","created_at":"%s"}`, id, id, created.UTC().Format(time.RFC3339))
+}
+
+func TestTwitterTimelinePagination(t *testing.T) {
+	base := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	var tokens []string
+	fakeTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("request sent without the bearer token")
+		}
+		if r.URL.Path != "/users/42/tweets" {
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("start_time") != "" {
+			t.Errorf("a feed that's never been polled shouldn't send start_time")
+		}
+		token := r.URL.Query().Get("pagination_token")
+		tokens = append(tokens, token)
+		switch token {
+		case "":
+			fmt.Fprintf(w, `{"data":[%s,%s],"meta":{"next_token":"page2"}}`, tweetJSON("4", base.Add(4*time.Minute)), tweetJSON("3", base.Add(3*time.Minute)))
+		case "page2":
+			fmt.Fprintf(w, `{"data":[%s,%s],"meta":{}}`, tweetJSON("2", base.Add(2*time.Minute)), tweetJSON("1", base.Add(time.Minute)))
+		default:
+			t.Errorf("unexpected pagination token %s", token)
+		}
+	})
+
+	tweets, err := twitterFeed{Username: "someone", UserID: "42"}.getTimeline(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tokens, ",") != ",page2" {
+		t.Errorf("requested pages %q, want the first page then page2", tokens)
+	}
+	var ids []string
+	for _, tw := range tweets {
+		ids = append(ids, tw.ID)
+		if tw.Username != "someone" {
+			t.Errorf("tweet %s has username %q, want the feed's", tw.ID, tw.Username)
+		}
+	}
+	if strings.Join(ids, ",") != "4,3,2,1" {
+		t.Errorf("got tweets %v, want 4,3,2,1", ids)
+	}
+}
+
+func TestTwitterTimelineMaxPages(t *testing.T) {
+	requests := 0
+	fakeTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"data":[%s],"meta":{"next_token":"more"}}`, tweetJSON(fmt.Sprint(requests), time.Now()))
+	})
+	conf.Polling.MaxPages = 3
+
+	tweets, err := twitterFeed{Username: "someone", UserID: "42"}.getTimeline(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 3 || len(tweets) != 3 {
+		t.Errorf("made %d requests for %d tweets, want 3 of each", requests, len(tweets))
+	}
+}
+
+func TestTwitterTimelineSinceID(t *testing.T) {
+	last := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	fakeTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("since_id") != "1" || query.Get("start_time") != "" {
+			t.Errorf("got since_id %q and start_time %q, want only the feed's last post id", query.Get("since_id"), query.Get("start_time"))
+		}
+		// A tweet posted in the same second as the last one seen is still new.
+		fmt.Fprintf(w, `{"data":[%s,%s],"meta":{}}`, tweetJSON("3", last.Add(time.Second)), tweetJSON("2", last))
+	})
+
+	tweets, err := twitterFeed{Username: "someone", UserID: "42", LastPostTime: last.Unix(), LastPostID: "1"}.getTimeline(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tweets) != 2 || tweets[0].ID != "3" || tweets[1].ID != "2" {
+		t.Errorf("got %v, want every tweet after the last post id", tweets)
+	}
+}
+
+func TestTwitterTimelineSkipsSeenTweets(t *testing.T) {
+	last := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	fakeTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		// Feeds polled before their last post id was kept fall back to the last post time.
+		if got := r.URL.Query().Get("start_time"); got != "2022-03-01T12:00:00Z" {
+			t.Errorf("start_time is %q, want the feed's last post time", got)
+		}
+		// start_time is inclusive, so the last tweet seen is returned again.
+		fmt.Fprintf(w, `{"data":[%s,%s,%s],"meta":{"next_token":"page2"}}`, tweetJSON("3", last.Add(2*time.Second)), tweetJSON("2", last.Add(time.Second)), tweetJSON("1", last))
+	})
+
+	tweets, err := twitterFeed{Username: "someone", UserID: "42", LastPostTime: last.Unix()}.getTimeline(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tweets) != 2 || tweets[0].ID != "3" || tweets[1].ID != "2" {
+		t.Errorf("got %v, want only the tweets after the last post time", tweets)
+	}
+}
+
+func TestTwitterTimelineCommission(t *testing.T) {
+	created := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	fakeTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"data":[{"id":"1","text":"YCH open, ends in 3 days","author_id":"42","created_at":"%s"}],"meta":{}}`, created.Format(time.RFC3339))
+	})
+
+	tweets, err := twitterFeed{Username: "someone", UserID: "42"}.getTimeline(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A relative deadline counts from when the tweet was posted, not from whenever it's notified.
+	want := created.Add(72 * time.Hour)
+	if len(tweets) != 1 || tweets[0].Commission == nil || !tweets[0].Commission.Deadline.Equal(want) {
+		t.Fatalf("got tweets %+v, want one with a deadline of %s", tweets, want)
+	}
+	if details := postCommission(tweets[0]); details != tweets[0].Commission {
+		t.Errorf("got commission %+v, want the one stored on the tweet", details)
+	}
+}
+
+func TestPollTwitterFeedNewFeedLimit(t *testing.T) {
+	base := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	fakeTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users/by/username/someone":
+			fmt.Fprint(w, `{"data":{"id":"42","username":"someone"}}`)
+		case "/users/42/tweets":
+			var data []string
+			for i := 7; i > 0; i-- {
+				data = append(data, tweetJSON(fmt.Sprint(i), base.Add(time.Duration(i)*time.Minute)))
+			}
+			fmt.Fprintf(w, `{"data":[%s],"meta":{}}`, strings.Join(data, ","))
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	})
+	conf.Polling.NewFeedNotificationLimit = 5
+
+	feed := twitterFeed{Username: "someone"}
+	err := db.insertTwitterFeed(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeQueue := make(chan postMessage, 10)
+	err = pollTwitterFeed(context.Background(), feed, writeQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(writeQueue)
+
+	i := 0
+	for msg := range writeQueue {
+		if msg.setNotify == nil || *msg.setNotify != (i < 5) {
+			t.Errorf("tweet %d of a new feed has setNotify %v, want %v", i, msg.setNotify, i < 5)
+		}
+		if msg.feed != "someone" {
+			t.Errorf("tweet %d queued from feed %q", i, msg.feed)
+		}
+		i++
+	}
+	if i != 7 {
+		t.Errorf("queued %d tweets, want 7", i)
+	}
+
+	feeds, err := db.getTwitterFeeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds) != 1 || feeds[0].UserID != "42" || feeds[0].LastPostTime != base.Add(7*time.Minute).Unix() || feeds[0].LastPostID != "7" || feeds[0].PostCount != 7 {
+		t.Errorf("saved feed %+v, want its user id, newest post, and post count", feeds)
+	}
+}
+
+func TestPollTwitterFeedExistingFeed(t *testing.T) {
+	last := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	fakeTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"data":[%s],"meta":{}}`, tweetJSON("2", last))
+	})
+
+	feed := twitterFeed{Username: "someone", UserID: "42", LastPostTime: last.Unix(), LastPostID: "1"}
+	err := db.insertTwitterFeed(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeQueue := make(chan postMessage, 10)
+	err = pollTwitterFeed(context.Background(), feed, writeQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-writeQueue
+	if msg.setNotify != nil {
+		t.Errorf("tweet from an existing feed has setNotify %v, want it left to the classifier", *msg.setNotify)
+	}
+
+	// The next poll asks for tweets after this one, even though it was posted in the same second as the last.
+	feeds, err := db.getTwitterFeeds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feeds) != 1 || feeds[0].LastPostID != "2" || feeds[0].LastPostTime != last.Unix() {
+		t.Errorf("saved feed %+v, want the newest tweet's id", feeds)
+	}
+}
+
+func TestNewerTweetID(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2", "1", true},
+		{"1", "2", false},
+		{"10", "9", true},
+		{"9", "10", false},
+		{"1", "1", false},
+		{"1", "", true},
+		{"", "1", false},
+	}
+	for _, test := range tests {
+		if got := newerTweetID(test.a, test.b); got != test.want {
+			t.Errorf("newerTweetID(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestTwitterErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"unauthorized", http.StatusUnauthorized, `{"title":"Unauthorized","detail":"Unauthorized","type":"about:blank","status":401}`, "401"},
+		{"rate limited", http.StatusTooManyRequests, `{"title":"Too Many Requests","detail":"Too Many Requests","type":"about:blank","status":429}`, "429"},
+		{"errors with 200", http.StatusOK, `{"errors":[{"title":"Authorization Error","detail":"Sorry, you are not authorized to see the user with id: [42]."}]}`, "not authorized"},
+		{"bad json", http.StatusOK, `{"data":`, "unexpected EOF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			})
+
+			_, err := twitterFeed{Username: "someone", UserID: "42"}.getTimeline(context.Background())
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got error %v, want one mentioning %q", err, test.want)
+			}
+
+			_, err = getTwitterUser(context.Background(), "someone")
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("user lookup got error %v, want one mentioning %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestPollTwitterFeedErrorLeavesFeed(t *testing.T) {
+	fakeTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	feed := twitterFeed{Username: "someone", UserID: "42", LastPostTime: 100}
+	err := db.insertTwitterFeed(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pollTwitterFeed(context.Background(), feed, make(chan postMessage, 10))
+	if err == nil {
+		t.Fatal("poll succeeded despite a 429")
+	}
+	feeds, _ := db.getTwitterFeeds()
+	if len(feeds) != 1 || feeds[0].LastPostTime != 100 {
+		t.Errorf("failed poll changed the feed to %+v", feeds)
+	}
+}
+
+func TestTwitterGetRequiresToken(t *testing.T) {
+	fakeTwitter(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request sent without a bearer token")
+	})
+	conf.Twitter.BearerToken = ""
+
+	_, err := getTwitterUser(context.Background(), "someone")
+	if err == nil {
+		t.Error("got no error without a bearer token")
+	}
+}
@@ -28,6 +28,22 @@ class SiteModel(ABC):
         
         pass
 
+    def predictMany(self, post_ids: List[str]) -> List[Dict]:
+        """Predict a batch of elements based on their IDs.
+
+        Sites should override this if they can predict a batch more efficiently than one at a time.
+
+        Inputs:
+        =======
+            post_ids: list(str)
+
+        Returns:
+        ========
+            predictions: list(dict)
+                the result of predict for each id, in the same order."""
+
+        return [self.predict(post_id) for post_id in post_ids]
+
     @abstractmethod
     def getStats(self) -> Dict[str, str]:
         """Get a set of statistics for the current model."""
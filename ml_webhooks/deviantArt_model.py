@@ -50,6 +50,8 @@ class DeviantArtModel(SiteModel):
             print("Using dummy predictor instead.")
 
             class DummyPredictor():
+                classes_ = np.array([False, True])
+
                 def __init__(self):
                     pass
 
@@ -61,9 +63,9 @@ class DeviantArtModel(SiteModel):
 
                 def predict_proba(self, X):
                     try:
-                        return np.array([[1.0, 0.0]] * len(X))
+                        return np.array([[0.0, 1.0]] * len(X))
                     except:
-                        return np.array([[1.0, 0.0]])
+                        return np.array([[0.0, 1.0]])
 
             self.clf = DummyPredictor()
             return
@@ -127,6 +129,11 @@ class DeviantArtModel(SiteModel):
         # Store the resulting model.
         self.clf = clf
 
+    def _notify_probabilities(self, X):
+        # predict_proba has a column per class, in the order of classes_, so find the one for notified posts.
+        positive = self.clf.classes_.tolist().index(True)
+        return self.clf.predict_proba(X)[:, positive]
+
     def predict(self, post_id):
         post_df = self._get_DevaintArt_data({'_id' : post_id})
 
@@ -140,9 +147,31 @@ class DeviantArtModel(SiteModel):
 
         X_post = post_df[features]
 
-        probability = self.clf.predict_proba(X_post)[0, 0]
+        probability = self._notify_probabilities(X_post)[0]
+        # Use the model's own decision, rather than a fixed cut-off on the score.
+        notify = bool(self.clf.predict(X_post)[0])
+
+        return {"success": True, "id" : post_id, "site": site, "notify": notify, "score" : probability}
+
+    def predictMany(self, post_ids):
+        # Fetch and score every post at once, rather than a query and prediction per post.
+        post_df = self._get_DevaintArt_data({'_id' : {"$in": post_ids}})
+
+        probabilities = {}
+        decisions = {}
+        if len(post_df) > 0:
+            probabilities = dict(zip(post_df.index, self._notify_probabilities(post_df[features])))
+            decisions = dict(zip(post_df.index, self.clf.predict(post_df[features])))
+
+        results = []
+        for post_id in post_ids:
+            if post_id not in probabilities:
+                results.append({'success': False, 'site':site, 'id' : post_id, 'error': "id not found in database."})
+                continue
+            probability = probabilities[post_id]
+            results.append({"success": True, "id" : post_id, "site": site, "notify": bool(decisions[post_id]), "score" : probability})
 
-        return {"success": True, "id" : post_id, "site": site, "notify": bool(probability >= 0), "score" : probability}
+        return results
 
     def getStats(self):
 
@@ -176,7 +205,7 @@ class DeviantArtModel(SiteModel):
         # Keep features as well as the ID to be returned.
         labelling_df = df[features]
 
-        labelling_df['probability'] = self.clf.predict_proba(labelling_df)[:,1]
+        labelling_df['probability'] = self._notify_probabilities(labelling_df)
         labelling_df['decision_distance'] = (labelling_df['probability'] - 0.5).abs()
         
         # Return the IDs of the posts with the `count` smallest distances from the seperating hyperplane.
@@ -48,13 +48,15 @@ def handle_retrain():
 
 @app.route('/classify')
 def handle_classify():
-    """Predict the notification probability of a post."""
+    """Predict the notification probability of a post.
+    
+    Pass a comma-separated list of ids as "ids" instead of "id" to classify a batch of posts in one request.
+    The batch response has a "results" list with one prediction per id."""
 
     post_id = request.args.get("id")
-    if post_id is None:
+    post_ids = request.args.get("ids")
+    if post_id is None and post_ids is None:
         return {"success": False, "error":"invalid_request", "error_description":"Must provide an id to be classified."}
-    else:
-        post_id = str(post_id)
 
     site = request.args.get("site")
     if site is None:
@@ -64,7 +66,10 @@ def handle_classify():
         # If the site name doesn't exist in the SITE_NAMES dictionary, return an error.
         return {"success": False, "error": f"Cannot find site {site}"}
     try:
-        return SITE_NAMES[site].predict(post_id)
+        if post_ids is not None:
+            post_ids = [post_id for post_id in post_ids.split(",") if post_id != ""]
+            return {"success": True, "site": site, "results": SITE_NAMES[site].predictMany(post_ids)}
+        return SITE_NAMES[site].predict(str(post_id))
     except Exception as e:
         return {"success": False, "error": repr(e)}
 